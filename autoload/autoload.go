@@ -0,0 +1,59 @@
+// Copyright 2019 The Konfig Authors. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+
+// Package autoload resolves konfig references as a side effect of being
+// imported:
+//
+//	import _ "github.com/kelseyhightower/konfig/autoload"
+//
+// Set KONFIG_STRICT=true to exit with a non-zero status, after logging
+// every failure, when any reference cannot be resolved, so the workload
+// fails to start rather than running with unresolved references.
+//
+// Set KONFIG_CLEANUP_ON_SIGTERM=true to remove the temp files written for
+// tempFile and tempDir references and exit when the process receives
+// SIGTERM. Programs with their own signal handling should leave it unset
+// and call konfig.Cleanup at the end of their shutdown.
+//
+// Programs that need control over the context, options or credentials
+// used should call konfig.Load directly instead.
+package autoload
+
+import (
+	"context"
+	"log"
+	"os"
+
+	"github.com/kelseyhightower/konfig"
+)
+
+func init() {
+	opts := konfig.Options{
+		Strict:          os.Getenv("KONFIG_STRICT") == "true",
+		CleanupOnSignal: os.Getenv("KONFIG_CLEANUP_ON_SIGTERM") == "true",
+	}
+
+	result, err := konfig.Load(context.Background(), opts)
+	if err == konfig.ErrUnknownRuntime {
+		log.Println(err)
+		return
+	}
+
+	if errs, ok := result.Err().(konfig.ReferenceErrors); ok {
+		for _, err := range errs {
+			log.Println(err)
+		}
+		if opts.Strict {
+			log.Fatalf("konfig: %d of %d references could not be resolved", len(errs), len(result.Variables))
+		}
+		return
+	}
+
+	if err != nil {
+		if opts.Strict {
+			log.Fatal(err)
+		}
+		log.Println(err)
+	}
+}
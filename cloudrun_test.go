@@ -0,0 +1,311 @@
+package konfig
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"golang.org/x/oauth2"
+)
+
+// newTestMetadataServer starts a fake metadata server serving values and
+// points GCE_METADATA_HOST at it.
+func newTestMetadataServer(t *testing.T, values map[string]string) func() {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Metadata-Flavor") != "Google" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		v, ok := values[strings.TrimPrefix(r.URL.Path, "/computeMetadata/v1/")]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(v))
+	}))
+
+	os.Setenv("GCE_METADATA_HOST", strings.TrimPrefix(server.URL, "http://"))
+	return func() {
+		os.Unsetenv("GCE_METADATA_HOST")
+		server.Close()
+	}
+}
+
+// newTestAPIServer starts a fake Cloud Run and Cloud Functions API serving
+// the JSON documents in resources by path, or 403 for the document
+// "forbidden", and points runEndpoint and
+// functionsEndpoint at it.
+func newTestAPIServer(t *testing.T, resources map[string]string) func() {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		v, ok := resources[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		if v == "forbidden" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.Write([]byte(v))
+	}))
+
+	savedRun, savedFunctions := runEndpoint, functionsEndpoint
+	runEndpoint = server.URL + "/%s/apis/%s/%s"
+	functionsEndpoint = server.URL + "/"
+	return func() {
+		runEndpoint, functionsEndpoint = savedRun, savedFunctions
+		server.Close()
+	}
+}
+
+var testTokenSource = oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "test"})
+
+func TestCloudRunRegion(t *testing.T) {
+	defer newTestMetadataServer(t, map[string]string{
+		"instance/region": "projects/123/regions/europe-west1",
+	})()
+	defer newTestAPIServer(t, map[string]string{
+		"/europe-west1/apis/serving.knative.dev/v1/namespaces/test-project/services/app": `{
+			"spec": {"template": {"spec": {"containers": [{"env": [{"name": "FOO", "value": "bar"}]}]}}}
+		}`,
+	})()
+
+	os.Setenv("K_SERVICE", "app")
+	os.Setenv("GOOGLE_CLOUD_PROJECT", "test-project")
+	defer os.Unsetenv("K_SERVICE")
+	defer os.Unsetenv("GOOGLE_CLOUD_PROJECT")
+
+	ctx := withSession(context.Background(), newSession(CloudRunRuntime, Options{TokenSource: testTokenSource}))
+	env, err := cloudRunDetector{}.EnvironmentVariables(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env["FOO"] != "bar" {
+		t.Errorf("unexpected environment variables %v", env)
+	}
+
+	// An explicit region takes precedence over the metadata server.
+	s := newSession(CloudRunRuntime, Options{Region: "asia-east1"})
+	if region, err := s.region(); err != nil || region != "asia-east1" {
+		t.Errorf("want asia-east1, got %s, %v", region, err)
+	}
+}
+
+func TestCloudRunRevision(t *testing.T) {
+	defer newTestAPIServer(t, map[string]string{
+		"/us-east1/apis/serving.knative.dev/v1/namespaces/test-project/revisions/app-00001": `{
+			"spec": {"containers": [{"env": [{"name": "VERSION", "value": "1"}]}]}
+		}`,
+		"/us-east1/apis/serving.knative.dev/v1/namespaces/test-project/services/app": `{
+			"spec": {"template": {"spec": {"containers": [{"env": [{"name": "VERSION", "value": "2"}]}]}}}
+		}`,
+	})()
+
+	os.Setenv("K_SERVICE", "app")
+	os.Setenv("GOOGLE_CLOUD_PROJECT", "test-project")
+	defer os.Unsetenv("K_SERVICE")
+	defer os.Unsetenv("GOOGLE_CLOUD_PROJECT")
+	defer os.Unsetenv("K_REVISION")
+
+	tests := []struct {
+		revision string
+		want     string
+	}{
+		{"app-00001", "1"},
+		{"app-00002", "2"}, // unknown revisions fall back to the service template
+		{"", "2"},
+	}
+
+	for _, tt := range tests {
+		os.Setenv("K_REVISION", tt.revision)
+
+		opts := Options{TokenSource: testTokenSource, Region: "us-east1"}
+		ctx := withSession(context.Background(), newSession(CloudRunRuntime, opts))
+		env, err := cloudRunDetector{}.EnvironmentVariables(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if env["VERSION"] != tt.want {
+			t.Errorf("revision %q: want VERSION=%s, got %v", tt.revision, tt.want, env)
+		}
+	}
+}
+
+func TestCloudRunJobs(t *testing.T) {
+	defer newTestAPIServer(t, map[string]string{
+		"/us-east1/apis/run.googleapis.com/v1/namespaces/test-project/executions/job-abc12": `{
+			"spec": {"template": {"spec": {"containers": [{"env": [{"name": "MODE", "value": "override"}]}]}}}
+		}`,
+		"/us-east1/apis/run.googleapis.com/v1/namespaces/test-project/jobs/job": `{
+			"spec": {"template": {"spec": {"template": {"spec": {"containers": [{"env": [{"name": "MODE", "value": "job"}]}]}}}}}
+		}`,
+	})()
+
+	os.Setenv("CLOUD_RUN_JOB", "job")
+	os.Setenv("GOOGLE_CLOUD_PROJECT", "test-project")
+	defer os.Unsetenv("CLOUD_RUN_JOB")
+	defer os.Unsetenv("GOOGLE_CLOUD_PROJECT")
+	defer os.Unsetenv("CLOUD_RUN_EXECUTION")
+
+	if e, ok := (cloudRunJobsDetector{}).Detect(); !ok || e != CloudRunJobsRuntime {
+		t.Errorf("want %s detected, got %s", CloudRunJobsRuntime, e)
+	}
+
+	for execution, want := range map[string]string{"job-abc12": "override", "job-unknown": "job"} {
+		os.Setenv("CLOUD_RUN_EXECUTION", execution)
+
+		opts := Options{TokenSource: testTokenSource, Region: "us-east1"}
+		ctx := withSession(context.Background(), newSession(CloudRunJobsRuntime, opts))
+		env, err := cloudRunJobsDetector{}.EnvironmentVariables(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if env["MODE"] != want {
+			t.Errorf("execution %s: want MODE=%s, got %v", execution, want, env)
+		}
+	}
+}
+
+func TestCloudFunctions(t *testing.T) {
+	defer newTestAPIServer(t, map[string]string{
+		"/v2/projects/test-project/locations/us-east1/functions/gen2": `{
+			"environment": "GEN_2",
+			"serviceConfig": {"environmentVariables": {"GEN": "2"}}
+		}`,
+		"/v1/projects/test-project/locations/us-east1/functions/gen1": `{
+			"environmentVariables": {"GEN": "1"}
+		}`,
+		"/us-east1/apis/serving.knative.dev/v1/namespaces/test-project/services/framework": `{
+			"spec": {"template": {"spec": {"containers": [{"env": [{"name": "GEN", "value": "run"}]}]}}}
+		}`,
+		"/v2/projects/test-project/locations/us-east1/functions/denied": "forbidden",
+		"/us-east1/apis/serving.knative.dev/v1/namespaces/test-project/services/denied": `{
+			"spec": {"template": {"spec": {"containers": [{"env": [{"name": "GEN", "value": "run"}]}]}}}
+		}`,
+		"/v1/projects/test-project/locations/us-east1/functions/denied-v1": "forbidden",
+		"/us-east1/apis/serving.knative.dev/v1/namespaces/test-project/services/denied-v1": `{
+			"spec": {"template": {"spec": {"containers": [{"env": [{"name": "GEN", "value": "run"}]}]}}}
+		}`,
+	})()
+
+	os.Setenv("FUNCTION_TARGET", "Handler")
+	os.Setenv("GOOGLE_CLOUD_PROJECT", "test-project")
+	defer os.Unsetenv("FUNCTION_TARGET")
+	defer os.Unsetenv("GOOGLE_CLOUD_PROJECT")
+	defer os.Unsetenv("K_SERVICE")
+
+	// Cloud Run services built with the Functions Framework are not known
+	// to the Cloud Functions API, or may not use it.
+	for name, want := range map[string]string{"gen2": "2", "gen1": "1", "framework": "run", "denied": "run", "denied-v1": "run"} {
+		os.Setenv("K_SERVICE", name)
+
+		e, d := detectRuntime()
+		if e != CloudFunctionsRuntime {
+			t.Fatalf("want %s detected, got %s", CloudFunctionsRuntime, e)
+		}
+
+		opts := Options{TokenSource: testTokenSource, Region: "us-east1"}
+		ctx := withSession(context.Background(), newSession(e, opts))
+		env, err := d.EnvironmentVariables(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if env["GEN"] != want {
+			t.Errorf("%s: want GEN=%s, got %v", name, want, env)
+		}
+	}
+}
+
+func TestMetadataFallback(t *testing.T) {
+	defer newTestMetadataServer(t, map[string]string{
+		"project/project-id":                      "metadata-project",
+		"instance/region":                         "projects/123/regions/us-west1",
+		"instance/service-accounts/default/email": "app@metadata-project.iam.gserviceaccount.com",
+	})()
+	defer newTestAPIServer(t, map[string]string{
+		"/us-west1/apis/serving.knative.dev/v1/namespaces/metadata-project/services/app": `{
+			"spec": {"template": {"spec": {"containers": [{"env": [{"name": "FOO", "value": "bar"}]}]}}}
+		}`,
+		"/us-west1/apis/serving.knative.dev/v1/namespaces/metadata-project/services/private": "forbidden",
+	})()
+
+	os.Setenv("K_SERVICE", "app")
+	defer os.Unsetenv("K_SERVICE")
+
+	ctx := withSession(context.Background(), newSession(CloudRunRuntime, Options{TokenSource: testTokenSource}))
+	env, err := cloudRunDetector{}.EnvironmentVariables(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env["FOO"] != "bar" {
+		t.Errorf("unexpected environment variables %v", env)
+	}
+
+	// Forbidden errors name the service account when the default
+	// credentials are used.
+	os.Setenv("K_SERVICE", "private")
+
+	s := newSession(CloudRunRuntime, Options{})
+	s.once.Do(func() {
+		s.tokenSource = testTokenSource
+		s.httpClient = oauth2.NewClient(context.Background(), testTokenSource)
+	})
+	_, err = cloudRunDetector{}.EnvironmentVariables(withSession(context.Background(), s))
+	if !errors.Is(err, ErrForbidden) || !strings.Contains(err.Error(), "app@metadata-project.iam.gserviceaccount.com") {
+		t.Errorf("want ErrForbidden naming the service account, got %v", err)
+	}
+}
+
+func TestCurrentContainer(t *testing.T) {
+	os.Setenv("KONFIG_TEST_FROM_SECRET", "resolved")
+	defer os.Unsetenv("KONFIG_TEST_FROM_SECRET")
+	defer os.Unsetenv("KONFIG_CONTAINER")
+
+	containers := []Container{
+		{Name: "sidecar", Env: []EnvVar{{Name: "ROLE", Value: "sidecar"}}},
+		{
+			Name:  "app",
+			Ports: []ContainerPort{{ContainerPort: 8080}},
+			Env: []EnvVar{
+				{Name: "ROLE", Value: "app"},
+				{Name: "KONFIG_TEST_FROM_SECRET", ValueFrom: &EnvVarSource{SecretKeyRef: &KeySelector{Name: "secret", Key: "latest"}}},
+			},
+		},
+	}
+
+	env, err := containerEnvironmentVariables(containers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env["ROLE"] != "app" || env["KONFIG_TEST_FROM_SECRET"] != "resolved" {
+		t.Errorf("want the ingress container, got %v", env)
+	}
+
+	os.Setenv("KONFIG_CONTAINER", "sidecar")
+	if env, err := containerEnvironmentVariables(containers); err != nil || env["ROLE"] != "sidecar" {
+		t.Errorf("want the sidecar container, got %v, %v", env, err)
+	}
+
+	os.Setenv("KONFIG_CONTAINER", "missing")
+	if _, err := containerEnvironmentVariables(containers); err == nil {
+		t.Error("want an error for a missing container")
+	}
+}
+
+func TestGetResourceStatus(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"error": {"code": 404, "message": "Resource 'app' of kind 'SERVICE' does not exist."}}`))
+	}))
+	defer server.Close()
+
+	var service Service
+	status, err := getResource(context.Background(), server.Client(), server.URL, &service)
+	if status != http.StatusNotFound || err == nil || !strings.Contains(err.Error(), "does not exist") {
+		t.Errorf("want 404 with the API error message, got %d, %v", status, err)
+	}
+}
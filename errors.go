@@ -0,0 +1,49 @@
+// Copyright 2019 The Konfig Authors. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+
+package konfig
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Errors reported while resolving a reference. Use errors.Is to test a
+// ReferenceError against them.
+var (
+	ErrInvalidReference = errors.New("invalid reference")
+	ErrClusterNotFound  = errors.New("cluster not found")
+	ErrForbidden        = errors.New("forbidden")
+	ErrObjectNotFound   = errors.New("object not found")
+	ErrKeyNotFound      = errors.New("key not found")
+	ErrDecode           = errors.New("unable to decode value")
+)
+
+// A ReferenceError records a failure to resolve the reference held by an
+// environment variable.
+type ReferenceError struct {
+	Name      string
+	Reference *Reference
+	Err       error
+}
+
+func (e *ReferenceError) Error() string {
+	return fmt.Sprintf("konfig: %s: %v", e.Name, e.Err)
+}
+
+func (e *ReferenceError) Unwrap() error {
+	return e.Err
+}
+
+// ReferenceErrors is a list of reference errors returned by Result.Err.
+type ReferenceErrors []*ReferenceError
+
+func (e ReferenceErrors) Error() string {
+	messages := make([]string, 0, len(e))
+	for _, err := range e {
+		messages = append(messages, err.Error())
+	}
+	return strings.Join(messages, "; ")
+}
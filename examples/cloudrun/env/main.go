@@ -15,6 +15,9 @@ import (
 	"os/signal"
 	"syscall"
 
+	// This example is pinned to konfig v0.0.1, which resolves references
+	// when the root package is imported. Later versions import
+	// github.com/kelseyhightower/konfig/autoload instead.
 	_ "github.com/kelseyhightower/konfig"
 )
 
@@ -1,8 +1,10 @@
 module github.com/kelseyhightower/konfig
 
-go 1.12
+go 1.13
 
 require (
+	cloud.google.com/go v0.34.0
 	golang.org/x/oauth2 v0.0.0-20190402181905-9f3314589c9a
 	google.golang.org/api v0.3.2
+	gopkg.in/yaml.v2 v2.4.0
 )
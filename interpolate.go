@@ -0,0 +1,155 @@
+// Copyright 2019 The Konfig Authors. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+
+package konfig
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// A templatePart is either literal text or an embedded reference.
+type templatePart struct {
+	text      string
+	reference string
+}
+
+// isTemplate reports whether s embeds or escapes at least one reference.
+func isTemplate(s string) bool {
+	_, ok := splitTemplate(s)
+	return ok
+}
+
+// splitTemplate splits s into literal text and the references embedded
+// with the ${SecretKeyRef:...} syntax. $$ is replaced by a literal $.
+// Text such as ${HOME} that does not name a registered provider is kept
+// as is. ok reports whether s embeds at least one reference, or escapes
+// one as $${SecretKeyRef:...}.
+func splitTemplate(s string) (parts []templatePart, ok bool) {
+	var text strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '$' || i+1 == len(s) {
+			text.WriteByte(s[i])
+			continue
+		}
+
+		switch s[i+1] {
+		case '$':
+			if strings.HasPrefix(s[i+2:], "{") {
+				if _, _, found := matchProvider("$" + s[i+3:]); found {
+					ok = true
+				}
+			}
+			text.WriteByte('$')
+			i++
+		case '{':
+			end := closingBrace(s[i+1:])
+			if end < 0 {
+				text.WriteByte('$')
+				continue
+			}
+			end++
+			reference := "$" + s[i+2:i+end]
+			if _, _, found := matchProvider(reference); !found {
+				text.WriteByte('$')
+				continue
+			}
+
+			if text.Len() > 0 {
+				parts = append(parts, templatePart{text: text.String()})
+				text.Reset()
+			}
+			parts = append(parts, templatePart{reference: reference})
+			i += end
+			ok = true
+		default:
+			text.WriteByte('$')
+		}
+	}
+
+	if text.Len() > 0 {
+		parts = append(parts, templatePart{text: text.String()})
+	}
+	return parts, ok
+}
+
+// closingBrace returns the index of the brace closing the one s starts
+// with, or -1 if it is not closed.
+func closingBrace(s string) int {
+	depth := 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '{':
+			depth++
+		case '}':
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// resolveTemplate resolves every reference embedded in value and splices
+// the values into place. Optional references to a missing value are
+// replaced by an empty string.
+func resolveTemplate(ctx context.Context, opts Options, variable *Variable, value string) []*Variable {
+	fail := func(err error) []*Variable {
+		variable.Err = err
+		return []*Variable{variable}
+	}
+
+	parts, _ := splitTemplate(value)
+
+	var b strings.Builder
+	for _, part := range parts {
+		if part.reference == "" {
+			b.WriteString(part.text)
+			continue
+		}
+
+		// A reference holding braces, such as ?default={}, cannot be
+		// told apart from the text around it.
+		if strings.ContainsAny(part.reference, "{}") {
+			return fail(fmt.Errorf("%w: embedded references cannot contain { or }", ErrInvalidReference))
+		}
+
+		reference, err := parseReference(part.reference)
+		if err != nil {
+			return fail(err)
+		}
+		variable.Embedded = append(variable.Embedded, reference)
+
+		if reference.Object {
+			return fail(fmt.Errorf("%w: whole-object references cannot be embedded", ErrInvalidReference))
+		}
+		for _, option := range []string{"tempFile", "tempDir", "setenv"} {
+			if _, ok := reference.Query[option]; ok {
+				return fail(fmt.Errorf("%w: %s is not supported by embedded references", ErrInvalidReference, option))
+			}
+		}
+
+		provider, ok := lookupProvider(reference.Prefix)
+		if !ok {
+			return fail(fmt.Errorf("%w: no provider for %s", ErrInvalidReference, reference.Prefix))
+		}
+
+		data, err := fetch(ctx, provider, reference)
+		if isMissing(err) && reference.Optional {
+			continue
+		}
+		if err != nil {
+			return fail(fmt.Errorf("%s%s: %w", reference.Prefix, reference.Path, err))
+		}
+		b.WriteString(string(data))
+	}
+
+	variable.Fingerprint = fingerprint([]byte(b.String()))
+	if err := publish(variable, b.String(), !opts.SkipSetenv); err != nil {
+		return fail(err)
+	}
+	return []*Variable{variable}
+}
@@ -6,57 +6,62 @@ package konfig
 
 import (
 	"context"
-	"crypto/tls"
-	"crypto/x509"
-	"encoding/base64"
-	"encoding/json"
 	"errors"
 	"fmt"
-	"io/ioutil"
-	"log"
-	"net/http"
 	"net/url"
 	"os"
 	"runtime"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"golang.org/x/oauth2"
-	"golang.org/x/oauth2/google"
-	"google.golang.org/api/cloudfunctions/v1"
-	"google.golang.org/api/container/v1"
 )
 
+// A Reference points to a value held by a provider, such as a key in a
+// Kubernetes secret or configmap.
 type Reference struct {
+	// Prefix is the reference prefix the provider is registered under,
+	// such as "$SecretKeyRef:".
+	Prefix string
+
+	// Path is the reference with the prefix and query options removed.
+	Path string
+
+	// Query holds the reference options, such as tempFile.
+	Query url.Values
+
+	// Cluster, Namespace, Name, Key and Kind identify a key in a
+	// Kubernetes secret or configmap. They are set by the built-in
+	// Kubernetes providers.
 	Cluster   string
 	Namespace string
 	Name      string
 	Key       string
-	TempFile  *os.File
 	Kind      string
-}
 
-type Secret struct {
-	ApiVersion string            `json:"apiVersion"`
-	Data       map[string]string `json:"data"`
-	Kind       string            `json:"kind"`
-}
+	// Object reports whether the reference points to a whole secret or
+	// configmap rather than a single key. Object references are resolved
+	// by providers implementing ObjectProvider.
+	Object bool
 
-type ConfigMap struct {
-	ApiVersion string            `json:"apiVersion"`
-	Data       map[string]string `json:"data"`
-	Kind       string            `json:"kind"`
-}
+	// Default is the value used when the referenced key or object does
+	// not exist, if HasDefault is set. It is set by the default option.
+	Default    string
+	HasDefault bool
 
-type RuntimeEnvironment string
+	// Optional reports whether a missing key or object is skipped rather
+	// than reported as a failure. It is set by the optional option.
+	Optional bool
 
-const (
-	CloudFunctionsRuntime = RuntimeEnvironment("cloudfunctions")
-	CloudRunRuntime       = RuntimeEnvironment("cloudrun")
-	UnknownRuntime        = RuntimeEnvironment("unknown")
-)
+	// ResourceVersion is the resourceVersion of the secret or configmap
+	// the value was read from. It is set when the reference is fetched.
+	ResourceVersion string
+}
 
-const runEndpoint = "https://us-central1-run.googleapis.com/apis/serving.knative.dev/v1/%s"
+const cloudPlatformScope = "https://www.googleapis.com/auth/cloud-platform"
 
 var (
 	projectName    = "konfig"
@@ -66,308 +71,538 @@ var (
 		projectName, projectVersion, projectURL, runtime.Version())
 )
 
-func init() {
-	parse()
+// Options configures how Load resolves references.
+type Options struct {
+	// TokenSource supplies the OAuth2 tokens used to call the Cloud Run,
+	// Cloud Functions, GKE, and Kubernetes APIs. If nil, the application
+	// default credentials are used.
+	TokenSource oauth2.TokenSource
+
+	// Runtime, if set, is used instead of detecting the runtime
+	// environment with the registered runtime detectors.
+	Runtime RuntimeDetector
+
+	// Region is the region the Cloud Run service or job, or the Cloud
+	// Function, runs in. If empty, the KONFIG_REGION environment variable
+	// or the metadata server is used.
+	Region string
+
+	// Parallelism is the maximum number of references resolved
+	// concurrently. If zero, 8 references are resolved concurrently.
+	Parallelism int
+
+	// Timeout, if non-zero, limits the time Load may take to list the
+	// environment variables and resolve every reference. Refresh applies
+	// it to every refresh.
+	Timeout time.Duration
+
+	// SkipSetenv stops resolved values from being written to the
+	// process environment, where child processes inherit them. Values
+	// remain available through Get and Lookup. The setenv reference
+	// option overrides it for a single reference.
+	SkipSetenv bool
+
+	// Strict makes Load return the errors reported by Result.Err when any
+	// reference cannot be resolved. It is also enabled by setting the
+	// KONFIG_STRICT environment variable to true.
+	Strict bool
+
+	// CleanupOnSignal makes Load install a handler that calls Cleanup
+	// when the process receives SIGTERM or SIGINT and then exits right
+	// away with status 128 plus the signal number. It is meant for
+	// programs without their own signal handling. Programs that shut down
+	// gracefully must leave it unset and call Cleanup once shutdown is
+	// complete: the handler would remove temp files the program may still
+	// be reading and end the process before its shutdown finishes.
+	CleanupOnSignal bool
+
+	// RefreshInterval, if non-zero, is how often Refresh re-resolves
+	// every reference.
+	RefreshInterval time.Duration
+
+	// WatchObjects makes Refresh re-resolve references as soon as the
+	// Kubernetes watch API reports a change to a referenced secret or
+	// configmap. Objects that cannot be watched, such as when the watch
+	// is forbidden, are only refreshed every RefreshInterval.
+	WatchObjects bool
 }
 
-func parse() {
-	runtimeEnvironment := detectRuntimeEnvironment()
-	if runtimeEnvironment == UnknownRuntime {
-		log.Println("konfig: unknown runtime environment")
-		return
+const defaultParallelism = 8
+
+// Result describes the outcome of a call to Load.
+type Result struct {
+	// Runtime is the detected runtime environment.
+	Runtime RuntimeEnvironment
+
+	// Variables holds the outcome of every environment variable that
+	// held a reference, sorted by name.
+	Variables []*Variable
+}
+
+// Err returns a ReferenceErrors listing every variable that could not be
+// resolved, or nil if all references were resolved.
+func (r *Result) Err() error {
+	var errs ReferenceErrors
+	for _, v := range r.Variables {
+		if v.Status == Failed {
+			errs = append(errs, &ReferenceError{Name: v.Name, Reference: v.Reference, Err: v.Err})
+		}
+	}
+	if len(errs) == 0 {
+		return nil
 	}
+	return errs
+}
 
-	environmentVariables, err := getEnvironmentVariables(runtimeEnvironment)
-	if err != nil {
-		log.Println(err)
-		return
+// Status describes the outcome of resolving a single environment variable.
+type Status string
+
+const (
+	Resolved = Status("resolved")
+	Failed   = Status("failed")
+
+	// Skipped reports that an optional reference pointed to a missing
+	// key or object. The environment variable is unset.
+	Skipped = Status("skipped")
+)
+
+// Variable describes the outcome of resolving the reference held by a
+// single environment variable.
+type Variable struct {
+	// Name is the name of the environment variable.
+	Name string
+
+	// Source is the name of the environment variable that held the
+	// reference. It differs from Name for variables expanded from a
+	// whole-object reference.
+	Source string
+
+	// Reference is the parsed reference. It is nil if the reference
+	// could not be parsed, or if the variable embeds references in a
+	// larger string.
+	Reference *Reference
+
+	// Embedded holds the references embedded in a larger string with the
+	// ${SecretKeyRef:...} syntax.
+	Embedded []*Reference
+
+	// Status reports whether the reference was resolved.
+	Status Status
+
+	// Fingerprint is the hex encoded SHA-256 hash of the resolved
+	// value. It identifies a value without revealing it.
+	Fingerprint string
+
+	// Err is non-nil when Status is Failed. It wraps one of the
+	// package's Err values when the cause of the failure is known.
+	Err error
+
+	// expanded reports whether the variable was expanded from a
+	// whole-object reference. Its value is held in data until
+	// resolveVariables checks that no other variable sets the same name.
+	expanded bool
+	data     []byte
+
+	// setenv reports whether the value was written to the environment.
+	setenv bool
+}
+
+// ErrUnknownRuntime is returned by Load when the process is not running
+// on a supported runtime environment.
+var ErrUnknownRuntime = errors.New("konfig: unknown runtime environment")
+
+// Load detects the runtime environment, retrieves the environment
+// variables declared for the running workload, and replaces each
+// configmap and secret reference with the value it points to.
+//
+// Load only returns an error when the environment variables cannot be
+// listed. Failures to resolve individual references are reported in the
+// returned Result, unless strict mode is enabled, in which case Load also
+// returns them as a ReferenceErrors.
+func Load(ctx context.Context, opts Options) (*Result, error) {
+	if opts.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.Timeout)
+		defer cancel()
 	}
 
-	if len(environmentVariables) == 0 {
-		return
+	var runtimeEnvironment RuntimeEnvironment
+	detector := opts.Runtime
+	if detector != nil {
+		runtimeEnvironment, _ = detector.Detect()
+	} else {
+		runtimeEnvironment, detector = detectRuntime()
 	}
 
-	// Setup the GKE HTTP client.
-	httpClient, err := google.DefaultClient(oauth2.NoContext,
-		"https://www.googleapis.com/auth/cloud-platform")
-	if err != nil {
-		log.Println(err)
-		return
+	result := &Result{Runtime: runtimeEnvironment}
+	if detector == nil {
+		return result, ErrUnknownRuntime
 	}
 
-	containerService, err := container.New(httpClient)
-	if err != nil {
-		log.Println(err)
-		return
+	if opts.CleanupOnSignal {
+		cleanupOnSignal()
 	}
-	containerService.UserAgent = userAgent
 
-	// Process the environment variable with secret references.
-	for k, v := range environmentVariables {
-		if !isReference(v) {
-			continue
-		}
+	ctx = withSession(ctx, newSession(runtimeEnvironment, opts))
 
-		reference, err := parseReference(v)
-		if err != nil {
-			log.Println(err)
-			continue
-		}
+	environmentVariables, err := detector.EnvironmentVariables(ctx)
+	if err != nil {
+		return result, err
+	}
 
-		clusterID := strings.TrimPrefix(reference.Cluster, "/")
+	if len(environmentVariables) == 0 {
+		return result, nil
+	}
 
-		cluster, err := containerService.Projects.Locations.Clusters.Get(clusterID).Context(context.Background()).Do()
-		if err != nil {
-			log.Println(err)
-			continue
+	references := make(map[string]string)
+	var declared []string
+	for k, v := range environmentVariables {
+		if isReference(v) || isTemplate(v) {
+			references[k] = v
+		} else {
+			declared = append(declared, k)
 		}
+	}
 
-		resourceURL := fmt.Sprintf("https://%s/api/v1/namespaces/%s/%ss/%s/", cluster.Endpoint,
-			reference.Namespace, reference.Kind, reference.Name)
+	result.Variables = resolveVariables(ctx, opts, references, declared)
+	state.save(runtimeEnvironment, references, declared, result.Variables)
 
-		caCert, err := base64.StdEncoding.DecodeString(cluster.MasterAuth.ClusterCaCertificate)
-		if err != nil {
-			log.Println(err)
-			continue
-		}
-
-		roots := x509.NewCertPool()
-		roots.AppendCertsFromPEM(caCert)
+	if opts.Strict || os.Getenv("KONFIG_STRICT") == "true" {
+		return result, result.Err()
+	}
+	return result, nil
+}
 
-		tr := &http.Transport{
-			MaxIdleConns:    10,
-			IdleConnTimeout: 30 * time.Second,
-			TLSClientConfig: &tls.Config{
-				RootCAs: roots,
-			},
-		}
+// resolveVariables resolves the references held by the named environment
+// variables using a bounded pool of workers. The returned variables are
+// sorted by name. declared names the environment variables that hold
+// plain values, which keys expanded from whole objects must not replace.
+func resolveVariables(ctx context.Context, opts Options, references map[string]string, declared []string) []*Variable {
+	names := make([]string, 0, len(references))
+	for k := range references {
+		names = append(names, k)
+	}
+	sort.Strings(names)
 
-		ts, err := google.DefaultTokenSource(context.TODO(), "https://www.googleapis.com/auth/cloud-platform")
-		if err != nil {
-			log.Println(err)
-			continue
-		}
+	parallelism := opts.Parallelism
+	if parallelism <= 0 {
+		parallelism = defaultParallelism
+	}
 
-		oauthTransport := &oauth2.Transport{
-			Base:   tr,
-			Source: ts,
-		}
+	// Each worker writes to its own slot so the results keep the sorted
+	// order.
+	resolved := make([][]*Variable, len(names))
+	indexes := make(chan int)
+
+	var wg sync.WaitGroup
+	for i := 0; i < parallelism && i < len(names); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				resolved[i] = resolveVariable(ctx, opts, names[i], references[names[i]])
+			}
+		}()
+	}
 
-		kubernetesClient := &http.Client{Transport: oauthTransport}
+	for i := range names {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
 
-		resp, err := kubernetesClient.Get(resourceURL)
-		if err != nil {
-			log.Println(err)
+	var variables []*Variable
+	for _, v := range resolved {
+		variables = append(variables, v...)
+	}
+	sort.SliceStable(variables, func(i, j int) bool {
+		return variables[i].Name < variables[j].Name
+	})
+
+	// Keys expanded from whole objects are only set once it is known that
+	// no other variable sets or declares the same name.
+	count := make(map[string]int)
+	for _, name := range declared {
+		count[name]++
+	}
+	for _, v := range variables {
+		count[v.Name]++
+	}
+	for _, v := range variables {
+		if !v.expanded || v.Err != nil {
 			continue
 		}
-
-		data, err := ioutil.ReadAll(resp.Body)
-		if err != nil {
-			log.Println(err)
+		if count[v.Name] > 1 {
+			v.Err = fmt.Errorf("%w: %s is already used by another environment variable", ErrInvalidReference, v.Name)
 			continue
 		}
+		if err := setValue(v, v.data, v.setenv); err != nil {
+			v.Err = err
+		}
+	}
 
-		defer resp.Body.Close()
+	return variables
+}
 
-		if resp.StatusCode != 200 {
-			log.Printf("kconfig: unable to get %s %s from Kubernetes status code %v",
-				k, reference.Kind, resp.StatusCode)
-			continue
-		}
+// resolveVariable resolves the reference held by the named environment
+// variable. Whole-object references expand into one variable per key.
+func resolveVariable(ctx context.Context, opts Options, name, value string) []*Variable {
+	variable := &Variable{Name: name, Source: name, Status: Failed}
+	fail := func(err error) []*Variable {
+		variable.Err = err
+		return []*Variable{variable}
+	}
 
-		var envData string
+	if !isReference(value) {
+		return resolveTemplate(ctx, opts, variable, value)
+	}
 
-		if reference.Kind == "secret" {
-			var secret Secret
-			err := json.Unmarshal(data, &secret)
-			if err != nil {
-				log.Println(err)
-				continue
-			}
+	reference, err := parseReference(value)
+	if err != nil {
+		return fail(err)
+	}
+	variable.Reference = reference
 
-			d, err := base64.StdEncoding.DecodeString(secret.Data[reference.Key])
-			if err != nil {
-				log.Println(err)
-				continue
-			}
-			envData = string(d)
+	setenv := !opts.SkipSetenv
+	if v := reference.Query.Get("setenv"); v != "" {
+		setenv, err = strconv.ParseBool(v)
+		if err != nil {
+			return fail(fmt.Errorf("%w: setenv=%s", ErrInvalidReference, v))
 		}
+	}
 
-		if reference.Kind == "configmap" {
-			var configmap ConfigMap
-
-			err := json.Unmarshal(data, &configmap)
-			if err != nil {
-				log.Println(err)
-				continue
-			}
+	provider, ok := lookupProvider(reference.Prefix)
+	if !ok {
+		return fail(fmt.Errorf("%w: no provider for %s", ErrInvalidReference, reference.Prefix))
+	}
 
-			envData = configmap.Data[reference.Key]
+	if !reference.Object {
+		data, err := fetch(ctx, provider, reference)
+		if isMissing(err) && reference.Optional {
+			return skip(variable, setenv)
+		}
+		if err != nil {
+			return fail(err)
+		}
+		if err := setValue(variable, data, setenv); err != nil {
+			return fail(err)
 		}
+		return []*Variable{variable}
+	}
 
-		if reference.TempFile != nil {
-			err = reference.TempFile.Chmod(600)
-			if err != nil {
-				log.Println(err)
-				continue
-			}
+	objectProvider, ok := provider.(ObjectProvider)
+	if !ok {
+		return fail(fmt.Errorf("%w: %s does not support whole-object references", ErrInvalidReference, reference.Prefix))
+	}
 
-			_, err = reference.TempFile.WriteString(envData)
-			if err != nil {
-				log.Println(err)
-				continue
-			}
+	mangle := reference.Query.Get("mangle")
+	if mangle != "" && mangle != "upper" && mangle != "none" {
+		return fail(fmt.Errorf("%w: mangle=%s", ErrInvalidReference, mangle))
+	}
 
-			err = reference.TempFile.Close()
-			if err != nil {
-				log.Println(err)
-				continue
-			}
+	object, err := objectProvider.FetchObject(ctx, reference)
+	if isMissing(err) && reference.Optional {
+		return skip(variable, setenv)
+	}
+	if err != nil {
+		return fail(err)
+	}
 
-			os.Setenv(k, reference.TempFile.Name())
+	object, err = transformObject(reference, object)
+	if err != nil {
+		return fail(err)
+	}
 
-			continue
+	if reference.Query.Get("tempDir") != "" {
+		dir, err := writeTempDir(name, reference, object)
+		if err != nil {
+			return fail(err)
 		}
-
-		os.Setenv(k, string(envData))
+		variable.Fingerprint = objectFingerprint(object)
+		if err := publish(variable, dir, setenv); err != nil {
+			return fail(err)
+		}
+		return []*Variable{variable}
 	}
-}
 
-func detectRuntimeEnvironment() RuntimeEnvironment {
-	if os.Getenv("FUNCTION_NAME") != "" {
-		return CloudFunctionsRuntime
+	keys := make([]string, 0, len(object))
+	for k := range object {
+		keys = append(keys, k)
 	}
+	sort.Strings(keys)
+
+	variables := make([]*Variable, 0, len(keys))
+	keyNames := make(map[string]string)
+	for _, key := range keys {
+		r := *reference
+		r.Key = key
+
+		v := &Variable{
+			Name:      reference.Query.Get("prefix") + mangleName(key, mangle),
+			Source:    name,
+			Reference: &r,
+			Status:    Failed,
+			expanded:  true,
+			data:      object[key],
+			setenv:    setenv,
+		}
+		if other, ok := keyNames[v.Name]; ok {
+			return fail(fmt.Errorf("%w: keys %s and %s both map to %s", ErrInvalidReference, other, key, v.Name))
+		}
+		keyNames[v.Name] = key
 
-	if os.Getenv("K_SERVICE") != "" {
-		return CloudRunRuntime
+		variables = append(variables, v)
 	}
 
-	return UnknownRuntime
-}
-
-func getEnvironmentVariables(e RuntimeEnvironment) (map[string]string, error) {
-	switch e {
-	case CloudRunRuntime:
-		return getCloudRunEnvironmentVariables()
-	case CloudFunctionsRuntime:
-		return getCloudFunctionsEnvironmentVariables()
+	// The variable only held the reference, so it is removed once the
+	// keys it expands into are set.
+	if setenv {
+		os.Unsetenv(name)
 	}
 
-	return nil, errors.New("unknown runtime environment")
+	return variables
 }
 
-func getCloudFunctionsEnvironmentVariables() (map[string]string, error) {
-	oauthHttpClient, err := google.DefaultClient(oauth2.NoContext,
-		"https://www.googleapis.com/auth/cloud-platform")
-	if err != nil {
-		return nil, err
-	}
-
-	client, err := cloudfunctions.New(oauthHttpClient)
-	if err != nil {
-		return nil, err
-	}
-	client.UserAgent = userAgent
+// setValue stores the resolved value of v and, if setenv is true, sets
+// the environment variable. Values of tempFile references are written to
+// a temp file and replaced by its path.
+func setValue(v *Variable, data []byte, setenv bool) error {
+	envData := string(data)
+	v.Fingerprint = fingerprint(data)
 
-	cloudFunction, err := client.Projects.Locations.Functions.Get(functionName()).Do()
-	if err != nil {
-		return nil, err
+	if v.Reference.Query.Get("tempFile") != "" {
+		path, err := writeTempFile(v.Name, v.Reference, data)
+		if err != nil {
+			return err
+		}
+		envData = path
 	}
 
-	return cloudFunction.EnvironmentVariables, nil
+	return publish(v, envData, setenv)
 }
 
-func getCloudRunEnvironmentVariables() (map[string]string, error) {
-	httpClient, err := google.DefaultClient(oauth2.NoContext,
-		"https://www.googleapis.com/auth/cloud-platform")
-	if err != nil {
-		return nil, err
+// publish stores value as the resolved value of v and, if setenv is
+// true, sets the environment variable.
+func publish(v *Variable, value string, setenv bool) error {
+	v.setenv = setenv
+	if setenv {
+		if err := os.Setenv(v.Name, value); err != nil {
+			return err
+		}
 	}
 
-	runEndPointUrl := fmt.Sprintf(runEndpoint, serviceName())
+	store.set(v.Name, value)
 
-	resp, err := httpClient.Get(runEndPointUrl)
-	if err != nil {
-		return nil, err
-	}
+	v.Status = Resolved
+	return nil
+}
 
-	data, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return nil, err
+// fetch returns the transformed value r points to, or its default value
+// if the key or object does not exist.
+func fetch(ctx context.Context, provider Provider, r *Reference) ([]byte, error) {
+	data, err := provider.Fetch(ctx, r)
+	if err == nil {
+		data, err = transform(r, data)
 	}
-
-	var s Service
-	if err := json.Unmarshal(data, &s); err != nil {
-		return nil, err
+	if isMissing(err) && r.HasDefault {
+		return []byte(r.Default), nil
 	}
+	return data, err
+}
 
-	environmentVariables := make(map[string]string)
-	for _, container := range s.Spec.RevisionTemplate.Spec.Containers {
-		for _, env := range container.Env {
-			environmentVariables[env.Name] = env.Value
-		}
+// skip unsets the environment variable of an optional reference that
+// points to a missing key or object, so the reference itself is not left
+// behind as its value.
+func skip(v *Variable, setenv bool) []*Variable {
+	if setenv {
+		os.Unsetenv(v.Name)
 	}
+	store.delete(v.Name)
 
-	return environmentVariables, nil
+	v.Status = Skipped
+	return []*Variable{v}
 }
 
-func serviceName() string {
-	service := os.Getenv("K_SERVICE")
-	project := os.Getenv("GOOGLE_CLOUD_PROJECT")
-	return fmt.Sprintf("namespaces/%s/services/%s", project, service)
+// isMissing reports whether err means the referenced key or object does
+// not exist.
+func isMissing(err error) bool {
+	return errors.Is(err, ErrKeyNotFound) || errors.Is(err, ErrObjectNotFound)
 }
 
-func functionName() string {
-	name := os.Getenv("FUNCTION_NAME")
-	project := os.Getenv("GCP_PROJECT")
-	region := os.Getenv("FUNCTION_REGION")
+// mangleName converts an object key into an environment variable name.
+// The default "upper" rule upper cases the key and replaces every
+// character other than letters, digits and underscores with an
+// underscore, so db.password becomes DB_PASSWORD. The "none" rule keeps
+// the key unchanged.
+func mangleName(key, rule string) string {
+	if rule == "none" {
+		return key
+	}
 
-	return fmt.Sprintf("projects/%s/locations/%s/functions/%s", project, region, name)
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_':
+			return r
+		}
+		return '_'
+	}, key)
 }
 
 func isReference(s string) bool {
-	if strings.HasPrefix(s, "$SecretKeyRef:") || strings.HasPrefix(s, "$ConfigMapKeyRef:") {
-		return true
-	}
-	return false
+	_, _, ok := matchProvider(s)
+	return ok
 }
 
 func parseReference(s string) (*Reference, error) {
-	var path string
-	var kind string
+	prefix, provider, ok := matchProvider(s)
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidReference, s)
+	}
 
-	if strings.HasPrefix(s, "$ConfigMapKeyRef:") {
-		path = strings.TrimPrefix(s, "$ConfigMapKeyRef:")
-		kind = "configmap"
+	u, err := url.Parse(strings.TrimPrefix(s, prefix))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidReference, err)
 	}
 
-	if strings.HasPrefix(s, "$SecretKeyRef:") {
-		path = strings.TrimPrefix(s, "$SecretKeyRef:")
-		kind = "secret"
+	r := &Reference{
+		Prefix: prefix,
+		Path:   u.Path,
+		Query:  u.Query(),
 	}
 
-	u, err := url.Parse(path)
-	if err != nil {
+	if v, ok := r.Query["default"]; ok {
+		r.Default, r.HasDefault = v[0], true
+	}
+	if v := r.Query.Get("optional"); v != "" {
+		r.Optional, err = strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("%w: optional=%s", ErrInvalidReference, v)
+		}
+	}
+
+	if err := provider.ParseReference(r); err != nil {
 		return nil, err
 	}
 
-	ss := strings.SplitN(u.Path, "/", 13)
+	if err := parseTransforms(r); err != nil {
+		return nil, err
+	}
 
-	var tempFile *os.File
-	if u.Query().Get("tempFile") != "" {
-		tempFile, err = ioutil.TempFile("", "")
-		if err != nil {
-			return nil, err
-		}
+	if r.Object && r.HasDefault {
+		return nil, fmt.Errorf("%w: default is not supported by whole-object references", ErrInvalidReference)
 	}
 
-	r := &Reference{
-		Cluster:   strings.Join(ss[0:7], "/"),
-		Namespace: ss[8],
-		Name:      ss[10],
-		Key:       ss[12],
-		Kind:      kind,
-		TempFile:  tempFile,
+	// Every key of a whole object is written to its own file, so a fixed
+	// file name cannot be used, and only whole objects fill a directory.
+	for _, option := range []string{"fileName", "keepExtension"} {
+		if _, ok := r.Query[option]; ok && r.Object {
+			return nil, fmt.Errorf("%w: %s is not supported by whole-object references", ErrInvalidReference, option)
+		}
+	}
+	if _, ok := r.Query["tempDir"]; ok && !r.Object {
+		return nil, fmt.Errorf("%w: tempDir is only supported by whole-object references", ErrInvalidReference)
 	}
 
 	return r, nil
@@ -1,7 +1,12 @@
 package konfig
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
 	"testing"
+	"time"
 )
 
 func TestParseSecretReference(t *testing.T) {
@@ -12,3 +17,200 @@ func TestParseSecretReference(t *testing.T) {
 		t.Errorf(err.Error())
 	}
 }
+
+func TestParseInvalidReference(t *testing.T) {
+	r := "$SecretKeyRef:/projects/hightowerlabs/locations/us-central1/clusters/api/secrets/app"
+
+	_, err := parseReference(r)
+	if !errors.Is(err, ErrInvalidReference) {
+		t.Errorf("want ErrInvalidReference, got %v", err)
+	}
+}
+
+func TestResultErr(t *testing.T) {
+	result := &Result{
+		Variables: []*Variable{
+			{Name: "FOO", Status: Resolved},
+			{Name: "BAR", Status: Failed, Err: fmt.Errorf("%w: foo", ErrKeyNotFound)},
+		},
+	}
+
+	err := result.Err()
+	errs, ok := err.(ReferenceErrors)
+	if !ok || len(errs) != 1 {
+		t.Fatalf("want 1 ReferenceErrors, got %v", err)
+	}
+	if errs[0].Name != "BAR" {
+		t.Errorf("want BAR, got %s", errs[0].Name)
+	}
+	if !errors.Is(errs[0], ErrKeyNotFound) {
+		t.Errorf("want ErrKeyNotFound, got %v", errs[0])
+	}
+}
+
+func TestLoadParallelism(t *testing.T) {
+	testProvider.delay = 20 * time.Millisecond
+	testProvider.maximum = 0
+	defer func() { testProvider.delay = 0 }()
+
+	env := make(map[string]string)
+	for i := 0; i < 10; i++ {
+		name := fmt.Sprintf("KONFIG_TEST_SLOW_%d", i)
+		testProvider.set(name, name)
+		env[name] = "$TestRef:" + name
+		defer os.Unsetenv(name)
+	}
+
+	result, err := Load(context.Background(), Options{
+		Runtime:     &fakeRuntime{env: env},
+		Parallelism: 3,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := result.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	if testProvider.maximum != 3 {
+		t.Errorf("want 3 concurrent fetches, got %d", testProvider.maximum)
+	}
+	for i, v := range result.Variables {
+		if want := fmt.Sprintf("KONFIG_TEST_SLOW_%d", i); v.Name != want {
+			t.Errorf("want %s at index %d, got %s", want, i, v.Name)
+		}
+	}
+}
+
+func TestLoadTimeout(t *testing.T) {
+	testProvider.delay = time.Second
+	defer func() { testProvider.delay = 0 }()
+	defer os.Unsetenv("KONFIG_TEST_SLOW")
+
+	result, err := Load(context.Background(), Options{
+		Runtime: &fakeRuntime{env: map[string]string{"KONFIG_TEST_SLOW": "$TestRef:foo"}},
+		Timeout: time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := result.Variables[0]; !errors.Is(v.Err, context.DeadlineExceeded) {
+		t.Errorf("want deadline exceeded, got %v", v.Err)
+	}
+}
+
+func TestMangleName(t *testing.T) {
+	tests := []struct {
+		key, rule, want string
+	}{
+		{"db.password", "", "DB_PASSWORD"},
+		{"tls-cert_2", "upper", "TLS_CERT_2"},
+		{"db.password", "none", "db.password"},
+	}
+
+	for _, tt := range tests {
+		if got := mangleName(tt.key, tt.rule); got != tt.want {
+			t.Errorf("mangleName(%q, %q) = %q, want %q", tt.key, tt.rule, got, tt.want)
+		}
+	}
+}
+
+func TestParseReferenceDefaultAndOptional(t *testing.T) {
+	r, err := parseReference("$TestRef:foo?default=&optional=true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !r.HasDefault || r.Default != "" || !r.Optional {
+		t.Errorf("unexpected reference %+v", r)
+	}
+
+	if _, err := parseReference("$TestRef:foo?optional=maybe"); !errors.Is(err, ErrInvalidReference) {
+		t.Errorf("want ErrInvalidReference, got %v", err)
+	}
+}
+
+func TestLoadWholeObjectNames(t *testing.T) {
+	values := map[string]string{
+		"dup/db.password":         "a",
+		"dup/db_password":         "b",
+		"app/user":                "admin",
+		"app/password":            "v1",
+		"other/password":          "other",
+		"plain/konfig_test_plain": "secret",
+	}
+	for k, v := range values {
+		testProvider.set(k, v)
+		defer testProvider.delete(k)
+	}
+	for _, name := range []string{"KONFIG_TEST_APP_USER", "KONFIG_TEST_APP_PASSWORD"} {
+		defer os.Unsetenv(name)
+		defer store.delete(name)
+	}
+
+	os.Setenv("KONFIG_TEST_PLAIN", "declared")
+	defer os.Unsetenv("KONFIG_TEST_PLAIN")
+
+	env := map[string]string{
+		"KONFIG_TEST_DUP":          "$TestRef:dup/",
+		"KONFIG_TEST_APP":          "$TestRef:app/?prefix=KONFIG_TEST_APP_",
+		"KONFIG_TEST_OTHER":        "$TestRef:other/?prefix=KONFIG_TEST_APP_",
+		"KONFIG_TEST_APP_PASSWORD": "$TestRef:foo",
+		"KONFIG_TEST_PLAIN":        "declared",
+		"KONFIG_TEST_PLAIN_OBJECT": "$TestRef:plain/",
+	}
+	opts := Options{Runtime: &fakeRuntime{env: env}}
+
+	result, err := Load(context.Background(), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	byName := make(map[string][]*Variable)
+	for _, v := range result.Variables {
+		byName[v.Name] = append(byName[v.Name], v)
+	}
+
+	// Keys mapping to the same name fail the whole expansion.
+	if vs := byName["KONFIG_TEST_DUP"]; len(vs) != 1 || !errors.Is(vs[0].Err, ErrInvalidReference) {
+		t.Errorf("want KONFIG_TEST_DUP to fail, got %+v", vs)
+	}
+	if _, ok := os.LookupEnv("DB_PASSWORD"); ok {
+		t.Error("want DB_PASSWORD unset")
+	}
+
+	// Expanded keys never override a name set by another variable.
+	for _, v := range byName["KONFIG_TEST_APP_PASSWORD"] {
+		if v.Source != "KONFIG_TEST_APP_PASSWORD" && !errors.Is(v.Err, ErrInvalidReference) {
+			t.Errorf("want expanded %s from %s to fail, got %v", v.Name, v.Source, v.Err)
+		}
+	}
+	if got := os.Getenv("KONFIG_TEST_APP_PASSWORD"); got != "bar" {
+		t.Errorf("want bar, got %s", got)
+	}
+
+	// Nor a name declared with a plain value.
+	if vs := byName["KONFIG_TEST_PLAIN"]; len(vs) != 1 || vs[0].Source != "KONFIG_TEST_PLAIN_OBJECT" || !errors.Is(vs[0].Err, ErrInvalidReference) {
+		t.Errorf("want expanded KONFIG_TEST_PLAIN to fail, got %+v", vs)
+	}
+	if got := os.Getenv("KONFIG_TEST_PLAIN"); got != "declared" {
+		t.Errorf("want declared, got %s", got)
+	}
+	if _, ok := Lookup("KONFIG_TEST_PLAIN"); ok {
+		t.Error("want KONFIG_TEST_PLAIN missing from the store")
+	}
+
+	if got := os.Getenv("KONFIG_TEST_APP_USER"); got != "admin" {
+		t.Errorf("want admin, got %s", got)
+	}
+
+	// Keys deleted from the object are unset on the next refresh.
+	testProvider.delete("app/user")
+	refresh(context.Background(), opts)
+
+	if v, ok := os.LookupEnv("KONFIG_TEST_APP_USER"); ok {
+		t.Errorf("want KONFIG_TEST_APP_USER unset, got %s", v)
+	}
+	if v, ok := Lookup("KONFIG_TEST_APP_USER"); ok {
+		t.Errorf("want KONFIG_TEST_APP_USER removed from the store, got %s", v)
+	}
+}
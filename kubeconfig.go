@@ -0,0 +1,294 @@
+// Copyright 2019 The Konfig Authors. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+
+package konfig
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+	"gopkg.in/yaml.v2"
+)
+
+// kubeconfig holds the parts of a kubeconfig file needed to connect to
+// a Kubernetes API server.
+type kubeconfig struct {
+	CurrentContext string            `yaml:"current-context"`
+	Clusters       []kubeconfigNamed `yaml:"clusters"`
+	Contexts       []kubeconfigNamed `yaml:"contexts"`
+	Users          []kubeconfigNamed `yaml:"users"`
+	dir            string
+}
+
+type kubeconfigNamed struct {
+	Name    string            `yaml:"name"`
+	Cluster kubeconfigCluster `yaml:"cluster"`
+	Context kubeconfigContext `yaml:"context"`
+	User    kubeconfigUser    `yaml:"user"`
+}
+
+type kubeconfigCluster struct {
+	Server                   string `yaml:"server"`
+	CertificateAuthority     string `yaml:"certificate-authority"`
+	CertificateAuthorityData string `yaml:"certificate-authority-data"`
+	InsecureSkipTLSVerify    bool   `yaml:"insecure-skip-tls-verify"`
+}
+
+type kubeconfigContext struct {
+	Cluster string `yaml:"cluster"`
+	User    string `yaml:"user"`
+}
+
+type kubeconfigUser struct {
+	Token                 string                `yaml:"token"`
+	TokenFile             string                `yaml:"tokenFile"`
+	ClientCertificate     string                `yaml:"client-certificate"`
+	ClientCertificateData string                `yaml:"client-certificate-data"`
+	ClientKey             string                `yaml:"client-key"`
+	ClientKeyData         string                `yaml:"client-key-data"`
+	AuthProvider          *kubeconfigAuthConfig `yaml:"auth-provider"`
+	Exec                  *kubeconfigExecConfig `yaml:"exec"`
+}
+
+type kubeconfigAuthConfig struct {
+	Name string `yaml:"name"`
+}
+
+type kubeconfigExecConfig struct {
+	Command string   `yaml:"command"`
+	Args    []string `yaml:"args"`
+	Env     []struct {
+		Name  string `yaml:"name"`
+		Value string `yaml:"value"`
+	} `yaml:"env"`
+}
+
+// execCredential is the output of a kubeconfig exec credential plugin.
+type execCredential struct {
+	Status struct {
+		Token               string    `json:"token"`
+		ExpirationTimestamp time.Time `json:"expirationTimestamp"`
+	} `json:"status"`
+}
+
+// loadKubeconfig reads the first kubeconfig file listed in the KUBECONFIG
+// environment variable, or $HOME/.kube/config.
+func loadKubeconfig() (*kubeconfig, error) {
+	path := filepath.SplitList(os.Getenv("KUBECONFIG"))
+	name := ""
+	if len(path) > 0 {
+		name = path[0]
+	}
+	if name == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, err
+		}
+		name = filepath.Join(home, ".kube", "config")
+	}
+
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+
+	var config kubeconfig
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("%w: kubeconfig %s: %v", ErrDecode, name, err)
+	}
+	config.dir = filepath.Dir(name)
+
+	return &config, nil
+}
+
+// contextName returns the kubeconfig context used to resolve r. In order
+// of precedence it is the context named by the reference context option,
+// the context gcloud creates for the referenced GKE cluster, or the
+// current context.
+func (c *kubeconfig) contextName(r *Reference) string {
+	if name := r.Query.Get("context"); name != "" {
+		return name
+	}
+
+	ss := strings.Split(strings.TrimPrefix(r.Cluster, "/"), "/")
+	if len(ss) == 6 {
+		name := fmt.Sprintf("gke_%s_%s_%s", ss[1], ss[3], ss[5])
+		if _, ok := c.lookup(c.Contexts, name); ok {
+			return name
+		}
+	}
+
+	return c.CurrentContext
+}
+
+func (c *kubeconfig) lookup(entries []kubeconfigNamed, name string) (kubeconfigNamed, bool) {
+	for _, e := range entries {
+		if e.Name == name {
+			return e, true
+		}
+	}
+	return kubeconfigNamed{}, false
+}
+
+// readData returns the decoded inline data, or the contents of the named
+// file relative to the kubeconfig file.
+func (c *kubeconfig) readData(data, file string) ([]byte, error) {
+	if data != "" {
+		d, err := base64.StdEncoding.DecodeString(data)
+		if err != nil {
+			return nil, fmt.Errorf("%w: kubeconfig: %v", ErrDecode, err)
+		}
+		return d, nil
+	}
+	if file == "" {
+		return nil, nil
+	}
+	if !filepath.IsAbs(file) {
+		file = filepath.Join(c.dir, file)
+	}
+	return ioutil.ReadFile(file)
+}
+
+// client returns the API server URL and an HTTP client configured from
+// the named context.
+func (c *kubeconfig) client(ctx context.Context, name string) (string, *http.Client, error) {
+	kubeContext, ok := c.lookup(c.Contexts, name)
+	if !ok {
+		return "", nil, fmt.Errorf("%w: kubeconfig context %q", ErrClusterNotFound, name)
+	}
+
+	cluster, ok := c.lookup(c.Clusters, kubeContext.Context.Cluster)
+	if !ok {
+		return "", nil, fmt.Errorf("%w: kubeconfig cluster %q", ErrClusterNotFound, kubeContext.Context.Cluster)
+	}
+
+	user, _ := c.lookup(c.Users, kubeContext.Context.User)
+
+	caCert, err := c.readData(cluster.Cluster.CertificateAuthorityData, cluster.Cluster.CertificateAuthority)
+	if err != nil {
+		return "", nil, err
+	}
+
+	certPEM, err := c.readData(user.User.ClientCertificateData, user.User.ClientCertificate)
+	if err != nil {
+		return "", nil, err
+	}
+
+	keyPEM, err := c.readData(user.User.ClientKeyData, user.User.ClientKey)
+	if err != nil {
+		return "", nil, err
+	}
+
+	key := strings.Join([]string{cluster.Cluster.Server, string(caCert), string(certPEM),
+		fmt.Sprint(cluster.Cluster.InsecureSkipTLSVerify)}, "\x00")
+
+	tr, err := sharedTransport(key, func() (*http.Transport, error) {
+		tlsConfig := &tls.Config{
+			InsecureSkipVerify: cluster.Cluster.InsecureSkipTLSVerify,
+		}
+
+		if caCert != nil {
+			tlsConfig.RootCAs = x509.NewCertPool()
+			tlsConfig.RootCAs.AppendCertsFromPEM(caCert)
+		}
+
+		if certPEM != nil {
+			cert, err := tls.X509KeyPair(certPEM, keyPEM)
+			if err != nil {
+				return nil, err
+			}
+			tlsConfig.Certificates = []tls.Certificate{cert}
+		}
+
+		return &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			MaxIdleConns:    10,
+			IdleConnTimeout: 90 * time.Second,
+			TLSClientConfig: tlsConfig,
+		}, nil
+	})
+	if err != nil {
+		return "", nil, err
+	}
+
+	var transport http.RoundTripper = tr
+
+	ts, err := c.tokenSource(ctx, user.User)
+	if err != nil {
+		return "", nil, err
+	}
+	if ts != nil {
+		transport = &oauth2.Transport{Base: transport, Source: ts}
+	}
+
+	server := strings.TrimSuffix(cluster.Cluster.Server, "/")
+	return server, &http.Client{Transport: transport}, nil
+}
+
+// tokenSource returns the bearer token source for user, or nil if user
+// authenticates with a client certificate only.
+func (c *kubeconfig) tokenSource(ctx context.Context, user kubeconfigUser) (oauth2.TokenSource, error) {
+	switch {
+	case user.Token != "":
+		return oauth2.StaticTokenSource(&oauth2.Token{AccessToken: user.Token}), nil
+	case user.TokenFile != "":
+		token, err := c.readData("", user.TokenFile)
+		if err != nil {
+			return nil, err
+		}
+		return oauth2.StaticTokenSource(&oauth2.Token{AccessToken: strings.TrimSpace(string(token))}), nil
+	case user.Exec != nil:
+		return oauth2.ReuseTokenSource(nil, &execTokenSource{config: user.Exec}), nil
+	case user.AuthProvider != nil && user.AuthProvider.Name == "gcp":
+		ts, _, err := sessionFromContext(ctx).credentials()
+		return ts, err
+	}
+	return nil, nil
+}
+
+// execTokenSource runs a kubeconfig exec credential plugin, such as
+// gke-gcloud-auth-plugin, to obtain a bearer token.
+type execTokenSource struct {
+	config *kubeconfigExecConfig
+}
+
+func (s *execTokenSource) Token() (*oauth2.Token, error) {
+	cmd := exec.Command(s.config.Command, s.config.Args...)
+	cmd.Env = os.Environ()
+	for _, env := range s.config.Env {
+		cmd.Env = append(cmd.Env, env.Name+"="+env.Value)
+	}
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("%w: kubeconfig exec %s: %v: %s", ErrForbidden,
+			s.config.Command, err, strings.TrimSpace(stderr.String()))
+	}
+
+	var credential execCredential
+	if err := json.Unmarshal(out, &credential); err != nil {
+		return nil, fmt.Errorf("%w: kubeconfig exec %s: %v", ErrDecode, s.config.Command, err)
+	}
+
+	return &oauth2.Token{
+		AccessToken: credential.Status.Token,
+		Expiry:      credential.Status.ExpirationTimestamp,
+	}, nil
+}
@@ -0,0 +1,309 @@
+package konfig
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// testCluster is a fake Kubernetes API server serving the env secret and
+// configmap in the default namespace.
+type testCluster struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	requests int
+	watches  []string
+}
+
+// newTestCluster starts a testCluster and points KUBECONFIG at it. The
+// returned func restores the environment.
+func newTestCluster(t *testing.T) (*testCluster, func()) {
+	cluster := &testCluster{}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/namespaces/default/secrets/env/", func(w http.ResponseWriter, r *http.Request) {
+		cluster.mu.Lock()
+		cluster.requests++
+		cluster.mu.Unlock()
+
+		if r.Header.Get("Authorization") != "Bearer test-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprintf(w, `{"kind":"Secret","metadata":{"resourceVersion":"1"},"data":{"foo":"%s","baz":"%s"}}`,
+			base64.StdEncoding.EncodeToString([]byte("bar")), base64.StdEncoding.EncodeToString([]byte("qux")))
+	})
+	mux.HandleFunc("/api/v1/namespaces/default/secrets", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if q.Get("watch") != "true" || q.Get("fieldSelector") != "metadata.name=env" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		cluster.mu.Lock()
+		cluster.watches = append(cluster.watches, q.Get("resourceVersion"))
+		cluster.mu.Unlock()
+
+		// Like the API server, report the current object as added when
+		// no resourceVersion is given.
+		if q.Get("resourceVersion") == "" {
+			fmt.Fprint(w, `{"type":"ADDED","object":{"kind":"Secret","metadata":{"name":"env","resourceVersion":"1"}}}`+"\n")
+			return
+		}
+		fmt.Fprint(w, `{"type":"MODIFIED","object":{"kind":"Secret","metadata":{"name":"env","resourceVersion":"2"}}}`+"\n")
+	})
+	mux.HandleFunc("/api/v1/namespaces/default/configmaps/env/", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"kind":"ConfigMap","metadata":{"resourceVersion":"1"},"data":{"environment":"production"}}`)
+	})
+	server := httptest.NewTLSServer(mux)
+	cluster.Server = server
+
+	caCert := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+
+	dir, err := ioutil.TempDir("", "konfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := fmt.Sprintf(`apiVersion: v1
+kind: Config
+current-context: test
+clusters:
+- name: test
+  cluster:
+    server: %s
+    certificate-authority-data: %s
+contexts:
+- name: test
+  context:
+    cluster: test
+    user: test
+users:
+- name: test
+  user:
+    token: test-token
+`, server.URL, base64.StdEncoding.EncodeToString(caCert))
+
+	name := filepath.Join(dir, "config")
+	if err := ioutil.WriteFile(name, []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	kubeconfig, ok := os.LookupEnv("KUBECONFIG")
+	os.Setenv("KUBECONFIG", name)
+
+	return cluster, func() {
+		server.Close()
+		os.RemoveAll(dir)
+		if ok {
+			os.Setenv("KUBECONFIG", kubeconfig)
+		} else {
+			os.Unsetenv("KUBECONFIG")
+		}
+	}
+}
+
+const testClusterID = "/projects/hightowerlabs/zones/us-central1-a/clusters/k0"
+
+func TestLoadLocal(t *testing.T) {
+	_, cleanup := newTestCluster(t)
+	defer cleanup()
+
+	os.Setenv("KONFIG_TEST_FOO", "$SecretKeyRef:"+testClusterID+"/namespaces/default/secrets/env/keys/foo")
+	os.Setenv("KONFIG_TEST_ENVIRONMENT", "$ConfigMapKeyRef:"+testClusterID+"/namespaces/default/configmaps/env/keys/environment")
+	defer os.Unsetenv("KONFIG_TEST_FOO")
+	defer os.Unsetenv("KONFIG_TEST_ENVIRONMENT")
+
+	result, err := Load(context.Background(), Options{Runtime: localDetector{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := result.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := os.Getenv("KONFIG_TEST_FOO"); got != "bar" {
+		t.Errorf("want bar, got %s", got)
+	}
+	if got := os.Getenv("KONFIG_TEST_ENVIRONMENT"); got != "production" {
+		t.Errorf("want production, got %s", got)
+	}
+}
+
+func TestLoadFetchesObjectOnce(t *testing.T) {
+	cluster, cleanup := newTestCluster(t)
+	defer cleanup()
+
+	env := map[string]string{
+		"KONFIG_TEST_FOO": "$SecretKeyRef:" + testClusterID + "/namespaces/default/secrets/env/keys/foo",
+		"KONFIG_TEST_BAZ": "$SecretKeyRef:" + testClusterID + "/namespaces/default/secrets/env/keys/baz",
+	}
+	defer os.Unsetenv("KONFIG_TEST_FOO")
+	defer os.Unsetenv("KONFIG_TEST_BAZ")
+
+	result, err := Load(context.Background(), Options{Runtime: &fakeRuntime{environment: LocalRuntime, env: env}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := result.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	if cluster.requests != 1 {
+		t.Errorf("want 1 request, got %d", cluster.requests)
+	}
+	for _, v := range result.Variables {
+		if v.Reference.ResourceVersion != "1" {
+			t.Errorf("%s: want resourceVersion 1, got %q", v.Name, v.Reference.ResourceVersion)
+		}
+	}
+	if got := os.Getenv("KONFIG_TEST_BAZ"); got != "qux" {
+		t.Errorf("want qux, got %s", got)
+	}
+}
+
+func TestKubernetesWatch(t *testing.T) {
+	_, cleanup := newTestCluster(t)
+	defer cleanup()
+
+	r, err := parseReference("$SecretKeyRef:" + testClusterID + "/namespaces/default/secrets/env/keys/foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.ResourceVersion = "1"
+
+	ctx := withSession(context.Background(), newSession(LocalRuntime, Options{}))
+
+	p, _ := lookupProvider(r.Prefix)
+	if err := p.(Watcher).Watch(ctx, r); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWatchDefaultForMissingKey(t *testing.T) {
+	cluster, cleanup := newTestCluster(t)
+	defer cleanup()
+
+	env := map[string]string{
+		"KONFIG_TEST_MISSING": "$SecretKeyRef:" + testClusterID + "/namespaces/default/secrets/env/keys/missing?default=none",
+	}
+	defer os.Unsetenv("KONFIG_TEST_MISSING")
+
+	result, err := Load(context.Background(), Options{Runtime: &fakeRuntime{environment: LocalRuntime, env: env}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := os.Getenv("KONFIG_TEST_MISSING"); got != "none" {
+		t.Errorf("want none, got %s", got)
+	}
+
+	references := watchedReferences(result.Variables)
+	if len(references) != 1 || references[0].ResourceVersion != "1" {
+		t.Fatalf("want one watched reference at resourceVersion 1, got %+v", references)
+	}
+
+	ctx := withSession(context.Background(), newSession(LocalRuntime, Options{}))
+	p, _ := lookupProvider(references[0].Prefix)
+	if err := p.(Watcher).Watch(ctx, references[0]); err != nil {
+		t.Fatal(err)
+	}
+	if len(cluster.watches) != 1 || cluster.watches[0] != "1" {
+		t.Errorf("want one watch from resourceVersion 1, got %q", cluster.watches)
+	}
+
+	// References without a resourceVersion are never watched.
+	r := *references[0]
+	r.ResourceVersion = ""
+	if err := p.(Watcher).Watch(ctx, &r); !errors.Is(err, errNotWatchable) {
+		t.Errorf("want errNotWatchable, got %v", err)
+	}
+	if len(cluster.watches) != 1 {
+		t.Errorf("want no new watch, got %q", cluster.watches)
+	}
+}
+
+func TestLoadWholeObject(t *testing.T) {
+	_, cleanup := newTestCluster(t)
+	defer cleanup()
+
+	os.Setenv("KONFIG_TEST_ENV", "$SecretKeyRef:"+testClusterID+"/namespaces/default/secrets/env?prefix=KONFIG_TEST_ENV_")
+	defer os.Unsetenv("KONFIG_TEST_ENV")
+	defer os.Unsetenv("KONFIG_TEST_ENV_FOO")
+	defer os.Unsetenv("KONFIG_TEST_ENV_BAZ")
+
+	env := map[string]string{"KONFIG_TEST_ENV": os.Getenv("KONFIG_TEST_ENV")}
+	result, err := Load(context.Background(), Options{Runtime: &fakeRuntime{environment: LocalRuntime, env: env}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := result.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(result.Variables) != 2 {
+		t.Fatalf("want 2 variables, got %d", len(result.Variables))
+	}
+	for _, v := range result.Variables {
+		if v.Source != "KONFIG_TEST_ENV" {
+			t.Errorf("%s: want source KONFIG_TEST_ENV, got %s", v.Name, v.Source)
+		}
+	}
+	if got := os.Getenv("KONFIG_TEST_ENV_FOO"); got != "bar" {
+		t.Errorf("want bar, got %s", got)
+	}
+	if got := os.Getenv("KONFIG_TEST_ENV_BAZ"); got != "qux" {
+		t.Errorf("want qux, got %s", got)
+	}
+	if _, ok := os.LookupEnv("KONFIG_TEST_ENV"); ok {
+		t.Error("want the whole-object reference to be unset")
+	}
+}
+
+func TestLoadTempDir(t *testing.T) {
+	_, cleanup := newTestCluster(t)
+	defer cleanup()
+
+	env := map[string]string{
+		"KONFIG_TEST_SECRETS": "$SecretKeyRef:" + testClusterID + "/namespaces/default/secrets/env?tempDir=true",
+	}
+	defer os.Unsetenv("KONFIG_TEST_SECRETS")
+
+	result, err := Load(context.Background(), Options{Runtime: &fakeRuntime{environment: LocalRuntime, env: env}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := result.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := os.Getenv("KONFIG_TEST_SECRETS")
+	defer os.RemoveAll(dir)
+
+	info, err := os.Stat(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0700 {
+		t.Errorf("want mode 0700, got %v", info.Mode().Perm())
+	}
+
+	for key, want := range map[string]string{"foo": "bar", "baz": "qux"} {
+		data, err := ioutil.ReadFile(filepath.Join(dir, key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != want {
+			t.Errorf("%s: want %s, got %s", key, want, data)
+		}
+	}
+}
@@ -0,0 +1,378 @@
+// Copyright 2019 The Konfig Authors. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+
+package konfig
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+	"google.golang.org/api/container/v1"
+	"google.golang.org/api/googleapi"
+)
+
+type Secret struct {
+	ApiVersion string            `json:"apiVersion"`
+	Data       map[string]string `json:"data"`
+	Kind       string            `json:"kind"`
+	Metadata   ObjectMeta        `json:"metadata"`
+}
+
+type ConfigMap struct {
+	ApiVersion string            `json:"apiVersion"`
+	Data       map[string]string `json:"data"`
+	Kind       string            `json:"kind"`
+	Metadata   ObjectMeta        `json:"metadata"`
+}
+
+type ObjectMeta struct {
+	Name            string `json:"name"`
+	Namespace       string `json:"namespace"`
+	ResourceVersion string `json:"resourceVersion"`
+}
+
+// kubernetesObject holds the data of a secret or configmap with secret
+// values already base64 decoded.
+type kubernetesObject struct {
+	resourceVersion string
+	data            map[string][]byte
+}
+
+func init() {
+	RegisterProvider("$SecretKeyRef:", &kubernetesProvider{kind: "secret"})
+	RegisterProvider("$ConfigMapKeyRef:", &kubernetesProvider{kind: "configmap"})
+}
+
+// kubernetesProvider retrieves keys from secrets or configmaps stored in
+// GKE clusters.
+type kubernetesProvider struct {
+	kind string
+}
+
+// ParseReference parses key references of the form:
+//
+//	/projects/*/locations/*/clusters/*/namespaces/*/secrets/*/keys/*
+//
+// and whole-object references, which omit the keys segment:
+//
+//	/projects/*/locations/*/clusters/*/namespaces/*/secrets/*
+func (p *kubernetesProvider) ParseReference(r *Reference) error {
+	ss := strings.SplitN(r.Path, "/", 13)
+	switch {
+	case len(ss) == 13 && ss[7] == "namespaces" && ss[11] == "keys" && ss[12] != "":
+		r.Key = ss[12]
+	case len(ss) == 11 && ss[7] == "namespaces":
+		r.Object = true
+	default:
+		return fmt.Errorf("%w: %s%s", ErrInvalidReference, r.Prefix, r.Path)
+	}
+
+	r.Cluster = strings.Join(ss[0:7], "/")
+	r.Namespace = ss[8]
+	r.Name = ss[10]
+	r.Kind = p.kind
+
+	return nil
+}
+
+// Fetch retrieves the value of the secret or configmap key pointed to by
+// r from its Kubernetes cluster and sets r.ResourceVersion to the version
+// of the object it was read from.
+func (p *kubernetesProvider) Fetch(ctx context.Context, r *Reference) ([]byte, error) {
+	object, err := p.object(ctx, r)
+	if err != nil {
+		return nil, err
+	}
+
+	// The version is recorded even if the key is missing, so a default
+	// value is refreshed when the key is added.
+	r.ResourceVersion = object.resourceVersion
+
+	v, ok := object.data[r.Key]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s in %s %s/%s", ErrKeyNotFound, r.Key, r.Kind, r.Namespace, r.Name)
+	}
+
+	return v, nil
+}
+
+// FetchObject retrieves every key of the secret or configmap pointed to
+// by r from its Kubernetes cluster.
+func (p *kubernetesProvider) FetchObject(ctx context.Context, r *Reference) (map[string][]byte, error) {
+	object, err := p.object(ctx, r)
+	if err != nil {
+		return nil, err
+	}
+	r.ResourceVersion = object.resourceVersion
+
+	data := make(map[string][]byte, len(object.data))
+	for k, v := range object.data {
+		data[k] = v
+	}
+	return data, nil
+}
+
+// object returns the secret or configmap r points to. Each object is
+// fetched once per session, so all keys read from an object during a
+// session come from the same resourceVersion.
+func (p *kubernetesProvider) object(ctx context.Context, r *Reference) (*kubernetesObject, error) {
+	key := strings.Join([]string{r.Cluster, r.Query.Get("context"), r.Namespace, r.Kind, r.Name}, "/")
+
+	v, err := sessionFromContext(ctx).do("object:"+key, func() (interface{}, error) {
+		return p.getObject(ctx, r)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.(*kubernetesObject), nil
+}
+
+func (p *kubernetesProvider) getObject(ctx context.Context, r *Reference) (*kubernetesObject, error) {
+	server, kubernetesClient, err := p.client(ctx, r)
+	if err != nil {
+		return nil, err
+	}
+
+	resourceURL := fmt.Sprintf("%s/api/v1/namespaces/%s/%ss/%s/", server,
+		r.Namespace, r.Kind, r.Name)
+
+	req, err := http.NewRequest("GET", resourceURL, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := kubernetesClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := statusError(resp.StatusCode, r); err != nil {
+		return nil, err
+	}
+
+	object := &kubernetesObject{data: make(map[string][]byte)}
+
+	if r.Kind == "secret" {
+		var secret Secret
+		if err := json.Unmarshal(data, &secret); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrDecode, err)
+		}
+
+		for k, v := range secret.Data {
+			d, err := base64.StdEncoding.DecodeString(v)
+			if err != nil {
+				return nil, fmt.Errorf("%w: key %s in secret %s/%s: %v", ErrDecode, k, r.Namespace, r.Name, err)
+			}
+			object.data[k] = d
+		}
+		object.resourceVersion = secret.Metadata.ResourceVersion
+
+		return object, nil
+	}
+
+	var configmap ConfigMap
+	if err := json.Unmarshal(data, &configmap); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrDecode, err)
+	}
+
+	for k, v := range configmap.Data {
+		object.data[k] = []byte(v)
+	}
+	object.resourceVersion = configmap.Metadata.ResourceVersion
+
+	return object, nil
+}
+
+// Watch blocks until the Kubernetes watch API reports a change to the
+// secret or configmap r points to after r.ResourceVersion, or ctx is
+// done. Watches closed by the API server are re-established.
+//
+// References without a ResourceVersion, such as a default value used for
+// a missing object, are not watched: the API server would report the
+// current object as a change right away.
+func (p *kubernetesProvider) Watch(ctx context.Context, r *Reference) error {
+	if r.ResourceVersion == "" {
+		return errNotWatchable
+	}
+
+	server, kubernetesClient, err := p.client(ctx, r)
+	if err != nil {
+		return err
+	}
+
+	q := url.Values{}
+	q.Set("watch", "true")
+	q.Set("fieldSelector", "metadata.name="+r.Name)
+	q.Set("resourceVersion", r.ResourceVersion)
+
+	watchURL := fmt.Sprintf("%s/api/v1/namespaces/%s/%ss?%s", server,
+		r.Namespace, r.Kind, q.Encode())
+
+	for {
+		changed, err := p.watch(ctx, kubernetesClient, watchURL, r)
+		if err != nil || changed {
+			return err
+		}
+	}
+}
+
+// watch reads watch events until the object changes or the API server
+// closes the watch.
+func (p *kubernetesProvider) watch(ctx context.Context, client *http.Client, watchURL string, r *Reference) (bool, error) {
+	req, err := http.NewRequest("GET", watchURL, nil)
+	if err != nil {
+		return false, err
+	}
+
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	if err := statusError(resp.StatusCode, r); err != nil {
+		return false, err
+	}
+
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var event struct {
+			Type   string `json:"type"`
+			Object struct {
+				Metadata ObjectMeta `json:"metadata"`
+			} `json:"object"`
+		}
+		if err := decoder.Decode(&event); err != nil {
+			if err == io.EOF {
+				return false, nil
+			}
+			return false, err
+		}
+
+		switch event.Type {
+		case "ADDED", "MODIFIED", "DELETED":
+			if event.Object.Metadata.ResourceVersion != r.ResourceVersion {
+				return true, nil
+			}
+		case "ERROR":
+			// The resourceVersion is too old to watch from. Report a
+			// change so the object is fetched again.
+			return true, nil
+		}
+	}
+}
+
+// statusError returns the error matching a Kubernetes API status code, or
+// nil for 200 OK.
+func statusError(code int, r *Reference) error {
+	switch code {
+	case http.StatusOK:
+		return nil
+	case http.StatusNotFound:
+		return fmt.Errorf("%w: %s %s/%s", ErrObjectNotFound, r.Kind, r.Namespace, r.Name)
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return fmt.Errorf("%w: get %s %s/%s", ErrForbidden, r.Kind, r.Namespace, r.Name)
+	}
+	return fmt.Errorf("unable to get %s %s/%s from Kubernetes status code %v",
+		r.Kind, r.Namespace, r.Name, code)
+}
+
+// client returns the API server URL and an HTTP client for the cluster
+// r points to. When running locally the cluster is looked up in the
+// kubeconfig file instead of the GKE API. Each cluster is looked up once
+// per session.
+func (p *kubernetesProvider) client(ctx context.Context, r *Reference) (string, *http.Client, error) {
+	s := sessionFromContext(ctx)
+
+	if s.runtime == LocalRuntime {
+		config, err := loadKubeconfig()
+		if err != nil {
+			return "", nil, err
+		}
+		name := config.contextName(r)
+		return s.cluster("kubeconfig:"+name, func() (string, *http.Client, error) {
+			return config.client(ctx, name)
+		})
+	}
+
+	return s.cluster(r.Cluster, func() (string, *http.Client, error) {
+		return gkeClient(ctx, s, r.Cluster)
+	})
+}
+
+// gkeClient looks up a GKE cluster using the GKE API and returns its API
+// server URL and an HTTP client authenticated with the session
+// credentials.
+func gkeClient(ctx context.Context, s *session, cluster string) (string, *http.Client, error) {
+	ts, httpClient, err := s.credentials()
+	if err != nil {
+		return "", nil, err
+	}
+
+	containerService, err := container.New(httpClient)
+	if err != nil {
+		return "", nil, err
+	}
+	containerService.UserAgent = userAgent
+
+	clusterID := strings.TrimPrefix(cluster, "/")
+
+	c, err := containerService.Projects.Locations.Clusters.Get(clusterID).Context(ctx).Do()
+	if err != nil {
+		if e, ok := err.(*googleapi.Error); ok {
+			switch e.Code {
+			case http.StatusNotFound:
+				return "", nil, fmt.Errorf("%w: %s", ErrClusterNotFound, clusterID)
+			case http.StatusUnauthorized, http.StatusForbidden:
+				return "", nil, fmt.Errorf("%w: get cluster %s: %s", ErrForbidden, clusterID, e.Message)
+			}
+		}
+		return "", nil, err
+	}
+
+	tr, err := sharedTransport(c.Endpoint+"\x00"+c.MasterAuth.ClusterCaCertificate, func() (*http.Transport, error) {
+		caCert, err := base64.StdEncoding.DecodeString(c.MasterAuth.ClusterCaCertificate)
+		if err != nil {
+			return nil, fmt.Errorf("%w: cluster CA certificate: %v", ErrDecode, err)
+		}
+
+		roots := x509.NewCertPool()
+		roots.AppendCertsFromPEM(caCert)
+
+		return &http.Transport{
+			MaxIdleConns:    10,
+			IdleConnTimeout: 90 * time.Second,
+			TLSClientConfig: &tls.Config{
+				RootCAs: roots,
+			},
+		}, nil
+	})
+	if err != nil {
+		return "", nil, err
+	}
+
+	oauthTransport := &oauth2.Transport{
+		Base:   tr,
+		Source: ts,
+	}
+
+	return "https://" + c.Endpoint, &http.Client{Transport: oauthTransport}, nil
+}
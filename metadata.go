@@ -0,0 +1,80 @@
+// Copyright 2019 The Konfig Authors. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+
+package konfig
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/compute/metadata"
+)
+
+// metadataTimeout limits each request to the metadata server, so Load
+// fails fast when the server cannot be reached.
+const metadataTimeout = 5 * time.Second
+
+var metadataClient = metadata.NewClient(&http.Client{Timeout: metadataTimeout})
+
+// metadata returns the value of the metadata server entry named by
+// suffix. Each entry is requested once per session.
+func (s *session) metadata(suffix string) (string, error) {
+	v, err := s.do("metadata:"+suffix, func() (interface{}, error) {
+		value, err := metadataClient.Get(suffix)
+		return strings.TrimSpace(value), err
+	})
+	if err != nil {
+		return "", fmt.Errorf("metadata server %s: %v", suffix, err)
+	}
+	return v.(string), nil
+}
+
+// region returns the region the workload runs in. In order of precedence
+// it is Options.Region, the KONFIG_REGION environment variable, the
+// FUNCTION_REGION environment variable set by older Cloud Functions
+// runtimes, or the region reported by the metadata server.
+func (s *session) region() (string, error) {
+	if s.regionName != "" {
+		return s.regionName, nil
+	}
+	for _, name := range []string{"KONFIG_REGION", "FUNCTION_REGION"} {
+		if region := os.Getenv(name); region != "" {
+			return region, nil
+		}
+	}
+
+	// The metadata server reports the region as
+	// projects/{project-number}/regions/{region}.
+	region, err := s.metadata("instance/region")
+	if err != nil {
+		return "", err
+	}
+	return path.Base(region), nil
+}
+
+// project returns the ID of the project the workload runs in, read from
+// the GOOGLE_CLOUD_PROJECT or GCP_PROJECT environment variables or the
+// metadata server.
+func (s *session) project() (string, error) {
+	for _, name := range []string{"GOOGLE_CLOUD_PROJECT", "GCP_PROJECT"} {
+		if project := os.Getenv(name); project != "" {
+			return project, nil
+		}
+	}
+	return s.metadata("project/project-id")
+}
+
+// serviceAccount returns the email of the service account the workload
+// runs as. It is only known when the default credentials are used.
+func (s *session) serviceAccount() (string, error) {
+	if !s.defaultCredentials {
+		return "", errors.New("konfig: credentials supplied by Options.TokenSource")
+	}
+	return s.metadata("instance/service-accounts/default/email")
+}
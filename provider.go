@@ -0,0 +1,88 @@
+// Copyright 2019 The Konfig Authors. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+
+package konfig
+
+import (
+	"context"
+	"strings"
+	"sync"
+)
+
+// A Provider retrieves the values pointed to by references that begin
+// with the prefix the provider is registered under.
+//
+// Fetch may be called concurrently.
+type Provider interface {
+	// ParseReference parses r.Path and sets the provider specific
+	// fields of r. It returns an error wrapping ErrInvalidReference if
+	// r.Path is malformed.
+	ParseReference(r *Reference) error
+
+	// Fetch returns the value r points to.
+	Fetch(ctx context.Context, r *Reference) ([]byte, error)
+}
+
+var (
+	providersMu sync.RWMutex
+	providers   = make(map[string]Provider)
+)
+
+// RegisterProvider makes a provider available to resolve references
+// beginning with prefix, such as "$SecretKeyRef:". The prefix must start
+// with "$" and end with ":". If RegisterProvider is called twice with the
+// same prefix, or if the prefix is malformed or p is nil, it panics.
+func RegisterProvider(prefix string, p Provider) {
+	providersMu.Lock()
+	defer providersMu.Unlock()
+
+	if p == nil {
+		panic("konfig: RegisterProvider provider is nil")
+	}
+	if len(prefix) < 3 || !strings.HasPrefix(prefix, "$") || !strings.HasSuffix(prefix, ":") {
+		panic("konfig: RegisterProvider malformed prefix " + prefix)
+	}
+	if _, dup := providers[prefix]; dup {
+		panic("konfig: RegisterProvider called twice for prefix " + prefix)
+	}
+	providers[prefix] = p
+}
+
+// lookupProvider returns the provider registered under prefix.
+func lookupProvider(prefix string) (Provider, bool) {
+	providersMu.RLock()
+	defer providersMu.RUnlock()
+
+	p, ok := providers[prefix]
+	return p, ok
+}
+
+// matchProvider returns the prefix and provider s begins with.
+func matchProvider(s string) (string, Provider, bool) {
+	providersMu.RLock()
+	defer providersMu.RUnlock()
+
+	for prefix, p := range providers {
+		if strings.HasPrefix(s, prefix) {
+			return prefix, p, true
+		}
+	}
+	return "", nil, false
+}
+
+// A Watcher is a Provider that can report changes to the values it
+// provides. Refresh uses it when Options.WatchObjects is set.
+type Watcher interface {
+	// Watch blocks until the value r points to may have changed since
+	// r was last fetched, or ctx is done.
+	Watch(ctx context.Context, r *Reference) error
+}
+
+// An ObjectProvider is a Provider that can fetch every key of the object
+// pointed to by a whole-object reference.
+type ObjectProvider interface {
+	// FetchObject returns the values of every key of the object r
+	// points to.
+	FetchObject(ctx context.Context, r *Reference) (map[string][]byte, error)
+}
@@ -0,0 +1,143 @@
+package konfig
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeProvider serves values set by tests. A reference ending in a slash
+// is a whole-object reference: "$TestRef:db/" expands the values stored
+// under keys starting with "db/". Fetch waits for delay, if set, and
+// records the maximum number of concurrent calls. Watch blocks until a
+// change is sent on changes or ctx is done, or returns watchErr if set.
+type fakeProvider struct {
+	mu       sync.Mutex
+	values   map[string]string
+	delay    time.Duration
+	active   int
+	maximum  int
+	watchErr error
+	changes  chan struct{}
+}
+
+func (p *fakeProvider) ParseReference(r *Reference) error {
+	if strings.HasSuffix(r.Path, "/") {
+		r.Object = true
+		r.Name = strings.TrimSuffix(r.Path, "/")
+		return nil
+	}
+	r.Key = r.Path
+	return nil
+}
+
+func (p *fakeProvider) Fetch(ctx context.Context, r *Reference) ([]byte, error) {
+	p.mu.Lock()
+	p.active++
+	if p.active > p.maximum {
+		p.maximum = p.active
+	}
+	delay := p.delay
+	p.mu.Unlock()
+
+	defer func() {
+		p.mu.Lock()
+		p.active--
+		p.mu.Unlock()
+	}()
+
+	if delay > 0 {
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	v, ok := p.values[r.Key]
+	if !ok {
+		return nil, ErrKeyNotFound
+	}
+	return []byte(v), nil
+}
+
+func (p *fakeProvider) FetchObject(ctx context.Context, r *Reference) (map[string][]byte, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	object := make(map[string][]byte)
+	for k, v := range p.values {
+		if strings.HasPrefix(k, r.Name+"/") {
+			object[strings.TrimPrefix(k, r.Name+"/")] = []byte(v)
+		}
+	}
+	if len(object) == 0 {
+		return nil, ErrObjectNotFound
+	}
+	return object, nil
+}
+
+func (p *fakeProvider) Watch(ctx context.Context, r *Reference) error {
+	p.mu.Lock()
+	err, changes := p.watchErr, p.changes
+	p.mu.Unlock()
+
+	if err != nil {
+		return err
+	}
+	select {
+	case <-changes:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (p *fakeProvider) set(key, value string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.values[key] = value
+}
+
+func (p *fakeProvider) delete(key string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.values, key)
+}
+
+var testProvider = &fakeProvider{values: map[string]string{"foo": "bar"}}
+
+func init() {
+	RegisterProvider("$TestRef:", testProvider)
+}
+
+func TestRegisterProvider(t *testing.T) {
+	if !isReference("$TestRef:foo") {
+		t.Fatal("want $TestRef:foo to be a reference")
+	}
+
+	r, err := parseReference("$TestRef:foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Prefix != "$TestRef:" || r.Key != "foo" {
+		t.Errorf("unexpected reference %+v", r)
+	}
+
+	p, ok := lookupProvider(r.Prefix)
+	if !ok {
+		t.Fatal("provider not registered")
+	}
+	data, err := p.Fetch(context.Background(), r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "bar" {
+		t.Errorf("want bar, got %s", data)
+	}
+}
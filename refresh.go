@@ -0,0 +1,424 @@
+// Copyright 2019 The Konfig Authors. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+
+package konfig
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// watchRetryInterval is how long Refresh waits before re-establishing a
+// watch that failed. The wait doubles with every consecutive failure, up
+// to maxWatchRetryInterval.
+const (
+	watchRetryInterval    = 10 * time.Second
+	maxWatchRetryInterval = 10 * time.Minute
+)
+
+// watchFailures tracks failing watches across refreshes. Watches denied
+// with ErrForbidden are stopped for good, since retrying cannot succeed
+// until permissions change, and the object is only refreshed every
+// RefreshInterval.
+var watchFailures = struct {
+	sync.Mutex
+	count   map[string]int
+	stopped map[string]bool
+}{count: make(map[string]int), stopped: make(map[string]bool)}
+
+// errNotWatchable is returned by Watch for references that cannot be
+// watched. They are only refreshed every RefreshInterval.
+var errNotWatchable = errors.New("konfig: reference cannot be watched")
+
+// loadState records the references resolved by the last call to Load so
+// Refresh can resolve them again.
+type loadState struct {
+	mu           sync.Mutex
+	loaded       bool
+	runtime      RuntimeEnvironment
+	references   map[string]string
+	declared     []string
+	variables    []*Variable
+	watched      []*Variable
+	fingerprints map[string]string
+	tempFiles    map[string]string
+}
+
+var state = &loadState{
+	fingerprints: make(map[string]string),
+	tempFiles:    make(map[string]string),
+}
+
+// save records the outcome of resolving references and returns the
+// previous fingerprint of every resolved or skipped variable. Skipped
+// variables have an empty fingerprint.
+func (s *loadState) save(e RuntimeEnvironment, references map[string]string, declared []string, variables []*Variable) map[string]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Unset the names an earlier run expanded an object into that are no
+	// longer produced, so deleted keys stop being readable. Names are kept
+	// while the object they came from cannot be fetched.
+	current := make(map[string]bool)
+	failed := make(map[string]bool)
+	for _, v := range variables {
+		current[v.Name] = true
+		if v.Status == Failed && !v.expanded {
+			failed[v.Name] = true
+		}
+	}
+	var carried []*Variable
+	for _, v := range s.variables {
+		if !v.expanded || v.Status != Resolved || current[v.Name] {
+			continue
+		}
+		if failed[v.Source] {
+			carried = append(carried, v)
+			continue
+		}
+		if v.setenv {
+			os.Unsetenv(v.Name)
+		}
+		store.delete(v.Name)
+		delete(s.fingerprints, v.Name)
+	}
+
+	s.loaded = true
+	s.runtime = e
+	s.references = references
+	s.declared = declared
+	s.variables = append(variables[:len(variables):len(variables)], carried...)
+
+	// Variables that failed to resolve keep watching the objects they were
+	// last resolved from, so a later change is still picked up when
+	// Refresh has no RefreshInterval to fall back on.
+	last := make(map[string]*Variable)
+	for _, v := range s.watched {
+		last[v.Name] = v
+	}
+	s.watched = nil
+	for _, v := range s.variables {
+		if v.Status == Failed && last[v.Name] != nil {
+			v = last[v.Name]
+		}
+		if v.Status == Resolved {
+			s.watched = append(s.watched, v)
+		}
+	}
+
+	previous := make(map[string]string)
+	for _, v := range variables {
+		if v.Status == Failed {
+			continue
+		}
+		previous[v.Name] = s.fingerprints[v.Name]
+		s.fingerprints[v.Name] = v.Fingerprint
+	}
+
+	// Remove the files of variables that no longer write to a file.
+	// Variables that failed to resolve keep their previous file.
+	keep := make(map[string]bool)
+	for _, v := range s.variables {
+		if v.Status == Failed || v.Status == Resolved && writesFile(v.Reference) {
+			keep[v.Name] = true
+		}
+	}
+	for name, path := range s.tempFiles {
+		if !keep[name] {
+			os.RemoveAll(path)
+			delete(s.tempFiles, name)
+		}
+	}
+
+	return previous
+}
+
+func (s *loadState) tempFile(name string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.tempFiles[name]
+}
+
+// setTempFile records the file or directory written for the named
+// variable, removing the one previously written if it moved.
+func (s *loadState) setTempFile(name, path string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if old, ok := s.tempFiles[name]; ok && old != path {
+		os.RemoveAll(old)
+	}
+	s.tempFiles[name] = path
+}
+
+var (
+	changeFuncsMu sync.Mutex
+	changeFuncs   []func(name, oldFingerprint, newFingerprint string)
+)
+
+// OnChange registers fn to be called by Refresh each time the value of
+// an environment variable changes. The fingerprints passed to fn are the
+// hex encoded SHA-256 hashes of the old and new values. oldFingerprint is
+// empty if the variable had not been resolved before.
+func OnChange(fn func(name, oldFingerprint, newFingerprint string)) {
+	changeFuncsMu.Lock()
+	defer changeFuncsMu.Unlock()
+	changeFuncs = append(changeFuncs, fn)
+}
+
+// Refresh keeps the values of resolved references up to date until ctx is
+// done. It re-resolves every reference each opts.RefreshInterval and, if
+// opts.WatchObjects is set, whenever a referenced Kubernetes secret or
+// configmap changes. Load is called first if it has not been called yet.
+//
+// Refreshed values replace the environment variables and the contents of
+// temp files in place. Failures are logged and leave the previous value
+// untouched.
+//
+// Refresh blocks, so it is typically run in its own goroutine:
+//
+//	go konfig.Refresh(ctx, konfig.Options{RefreshInterval: 5 * time.Minute})
+func Refresh(ctx context.Context, opts Options) error {
+	if opts.RefreshInterval <= 0 && !opts.WatchObjects {
+		return errors.New("konfig: Refresh requires RefreshInterval or WatchObjects")
+	}
+
+	state.mu.Lock()
+	loaded := state.loaded
+	state.mu.Unlock()
+
+	if !loaded {
+		if _, err := Load(ctx, opts); err != nil {
+			return err
+		}
+	}
+
+	for {
+		if err := waitForChange(ctx, opts); err != nil {
+			return err
+		}
+		refresh(ctx, opts)
+	}
+}
+
+// waitForChange blocks until the refresh interval elapses, a watched
+// object changes, or ctx is done.
+func waitForChange(ctx context.Context, opts Options) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	changed := make(chan struct{}, 1)
+	signal := func() {
+		select {
+		case changed <- struct{}{}:
+		default:
+		}
+	}
+
+	if opts.RefreshInterval > 0 {
+		timer := time.AfterFunc(opts.RefreshInterval, signal)
+		defer timer.Stop()
+	}
+
+	if opts.WatchObjects {
+		state.mu.Lock()
+		e, variables := state.runtime, state.watched
+		state.mu.Unlock()
+
+		wctx := withSession(ctx, newSession(e, opts))
+		for _, r := range watchedReferences(variables) {
+			go watch(wctx, opts, r, signal)
+		}
+	}
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-changed:
+		return nil
+	}
+}
+
+// watchedReferences returns one resolved reference per watchable object.
+func watchedReferences(variables []*Variable) []*Reference {
+	seen := make(map[string]bool)
+
+	var references []*Reference
+	for _, v := range variables {
+		if v.Status != Resolved {
+			continue
+		}
+
+		for _, r := range append([]*Reference{v.Reference}, v.Embedded...) {
+			if r == nil {
+				continue
+			}
+
+			key := watchKey(r)
+			if seen[key] || watchStopped(key) {
+				continue
+			}
+			seen[key] = true
+
+			references = append(references, r)
+		}
+	}
+	return references
+}
+
+// watchKey identifies the object watched for r.
+func watchKey(r *Reference) string {
+	if r.Kind != "" {
+		return strings.Join([]string{r.Cluster, r.Query.Get("context"), r.Namespace, r.Kind, r.Name}, "/")
+	}
+	return r.Prefix + r.Path
+}
+
+func watchStopped(key string) bool {
+	watchFailures.Lock()
+	defer watchFailures.Unlock()
+	return watchFailures.stopped[key]
+}
+
+// watchRetryDelay records a failed watch of the object identified by key
+// and returns how long to wait before retrying it.
+func watchRetryDelay(key string) time.Duration {
+	watchFailures.Lock()
+	defer watchFailures.Unlock()
+
+	watchFailures.count[key]++
+	delay := watchRetryInterval
+	for i := 1; i < watchFailures.count[key] && delay < maxWatchRetryInterval; i++ {
+		delay *= 2
+	}
+	if delay > maxWatchRetryInterval {
+		delay = maxWatchRetryInterval
+	}
+	return delay
+}
+
+// watch calls signal when the object r points to changes. Watch failures
+// are retried with an exponential backoff by triggering a refresh, which
+// also re-establishes the watch from the latest resourceVersion. Watches
+// denied with ErrForbidden are not retried.
+func watch(ctx context.Context, opts Options, r *Reference, signal func()) {
+	provider, ok := lookupProvider(r.Prefix)
+	if !ok {
+		return
+	}
+
+	w, ok := provider.(Watcher)
+	if !ok {
+		return
+	}
+
+	key := watchKey(r)
+
+	err := w.Watch(ctx, r)
+	if err == nil {
+		watchFailures.Lock()
+		delete(watchFailures.count, key)
+		watchFailures.Unlock()
+
+		signal()
+		return
+	}
+
+	if ctx.Err() != nil || errors.Is(err, errNotWatchable) {
+		return
+	}
+
+	if errors.Is(err, ErrForbidden) {
+		watchFailures.Lock()
+		watchFailures.stopped[key] = true
+		watchFailures.Unlock()
+
+		if opts.RefreshInterval > 0 {
+			log.Printf("konfig: watch %s%s: %v: no longer watching, relying on RefreshInterval", r.Prefix, r.Path, err)
+		} else {
+			log.Printf("konfig: watch %s%s: %v: no longer watching, set RefreshInterval to keep refreshing it", r.Prefix, r.Path, err)
+		}
+		return
+	}
+
+	delay := watchRetryDelay(key)
+	log.Printf("konfig: watch %s%s: %v: retrying in %v", r.Prefix, r.Path, err, delay)
+
+	select {
+	case <-time.After(delay):
+	case <-ctx.Done():
+		return
+	}
+
+	signal()
+}
+
+// refresh resolves the references recorded by the last call to Load
+// again and calls the OnChange functions for every changed value.
+func refresh(ctx context.Context, opts Options) {
+	if opts.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.Timeout)
+		defer cancel()
+	}
+
+	state.mu.Lock()
+	e, references, declared := state.runtime, state.references, state.declared
+	state.mu.Unlock()
+
+	ctx = withSession(ctx, newSession(e, opts))
+
+	variables := resolveVariables(ctx, opts, references, declared)
+	previous := state.save(e, references, declared, variables)
+
+	changeFuncsMu.Lock()
+	fns := changeFuncs
+	changeFuncsMu.Unlock()
+
+	for _, v := range variables {
+		if v.Status == Failed {
+			log.Println(&ReferenceError{Name: v.Name, Reference: v.Reference, Err: v.Err})
+			continue
+		}
+
+		if old := previous[v.Name]; old != v.Fingerprint {
+			for _, fn := range fns {
+				fn(v.Name, old, v.Fingerprint)
+			}
+		}
+	}
+}
+
+// fingerprint returns the hex encoded SHA-256 hash of data.
+func fingerprint(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// objectFingerprint returns the hex encoded SHA-256 hash of every key and
+// value of object.
+func objectFingerprint(object map[string][]byte) string {
+	keys := make([]string, 0, len(object))
+	for k := range object {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	h := sha256.New()
+	for _, k := range keys {
+		h.Write([]byte(k))
+		h.Write([]byte{0})
+		h.Write(object[k])
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
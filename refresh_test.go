@@ -0,0 +1,154 @@
+package konfig
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestRefresh(t *testing.T) {
+	testProvider.set("password", "v1")
+	testProvider.set("config", "{}")
+
+	env := map[string]string{
+		"KONFIG_TEST_PASSWORD": "$TestRef:password",
+		"KONFIG_TEST_CONFIG":   "$TestRef:config?tempFile=true",
+	}
+	defer os.Unsetenv("KONFIG_TEST_PASSWORD")
+	defer os.Unsetenv("KONFIG_TEST_CONFIG")
+
+	opts := Options{Runtime: &fakeRuntime{env: env}}
+	if _, err := Load(context.Background(), opts); err != nil {
+		t.Fatal(err)
+	}
+
+	configFile := os.Getenv("KONFIG_TEST_CONFIG")
+	defer os.Remove(configFile)
+
+	changes := make(map[string][2]string)
+	OnChange(func(name, oldFingerprint, newFingerprint string) {
+		changes[name] = [2]string{oldFingerprint, newFingerprint}
+	})
+
+	testProvider.set("password", "v2")
+	testProvider.set("config", `{"debug":true}`)
+	refresh(context.Background(), opts)
+
+	if got := os.Getenv("KONFIG_TEST_PASSWORD"); got != "v2" {
+		t.Errorf("want v2, got %s", got)
+	}
+
+	change, ok := changes["KONFIG_TEST_PASSWORD"]
+	if !ok {
+		t.Fatal("want KONFIG_TEST_PASSWORD change")
+	}
+	if change[0] != fingerprint([]byte("v1")) || change[1] != fingerprint([]byte("v2")) {
+		t.Errorf("unexpected fingerprints %v", change)
+	}
+
+	if got := os.Getenv("KONFIG_TEST_CONFIG"); got != configFile {
+		t.Errorf("want temp file %s to be reused, got %s", configFile, got)
+	}
+	data, err := ioutil.ReadFile(configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != `{"debug":true}` {
+		t.Errorf("unexpected temp file contents %s", data)
+	}
+}
+
+func TestWatchForbidden(t *testing.T) {
+	testProvider.watchErr = fmt.Errorf("%w: watch", ErrForbidden)
+	defer func() { testProvider.watchErr = nil }()
+
+	r, err := parseReference("$TestRef:watched")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		watchFailures.Lock()
+		delete(watchFailures.stopped, watchKey(r))
+		watchFailures.Unlock()
+	}()
+
+	signaled := false
+	watch(context.Background(), Options{}, r, func() { signaled = true })
+	if signaled {
+		t.Error("want no refresh after a forbidden watch")
+	}
+
+	variables := []*Variable{{Name: "KONFIG_TEST_WATCHED", Reference: r, Status: Resolved}}
+	if references := watchedReferences(variables); len(references) != 0 {
+		t.Errorf("want forbidden watch stopped, got %v", references)
+	}
+}
+
+func TestWatchRetryDelay(t *testing.T) {
+	key := "$TestRef:retry"
+	defer func() {
+		watchFailures.Lock()
+		delete(watchFailures.count, key)
+		watchFailures.Unlock()
+	}()
+
+	want := []time.Duration{10 * time.Second, 20 * time.Second, 40 * time.Second, 80 * time.Second,
+		160 * time.Second, 320 * time.Second, 10 * time.Minute, 10 * time.Minute}
+	for i, w := range want {
+		if got := watchRetryDelay(key); got != w {
+			t.Errorf("failure %d: want %v, got %v", i+1, w, got)
+		}
+	}
+}
+
+func TestWatchAfterFailedRefresh(t *testing.T) {
+	testProvider.set("watched", "v1")
+	defer testProvider.delete("watched")
+	defer os.Unsetenv("KONFIG_TEST_WATCHED")
+	defer store.delete("KONFIG_TEST_WATCHED")
+
+	changes := make(chan struct{})
+	testProvider.mu.Lock()
+	testProvider.changes = changes
+	testProvider.mu.Unlock()
+	defer func() {
+		testProvider.mu.Lock()
+		testProvider.changes = nil
+		testProvider.mu.Unlock()
+	}()
+
+	env := map[string]string{"KONFIG_TEST_WATCHED": "$TestRef:watched"}
+	opts := Options{Runtime: &fakeRuntime{env: env}, WatchObjects: true}
+	if _, err := Load(context.Background(), opts); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go Refresh(ctx, opts)
+
+	change := func() {
+		select {
+		case changes <- struct{}{}:
+		case <-time.After(5 * time.Second):
+			t.Fatal("want the object to be watched")
+		}
+	}
+
+	// The refresh triggered by the first change fails. The object must
+	// still be watched for the second one.
+	testProvider.delete("watched")
+	change()
+	testProvider.set("watched", "v2")
+	change()
+
+	for i := 0; i < 100 && os.Getenv("KONFIG_TEST_WATCHED") != "v2"; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := os.Getenv("KONFIG_TEST_WATCHED"); got != "v2" {
+		t.Errorf("want v2, got %s", got)
+	}
+}
@@ -0,0 +1,414 @@
+// Copyright 2019 The Konfig Authors. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+
+package konfig
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"google.golang.org/api/cloudfunctions/v1"
+	"google.golang.org/api/googleapi"
+)
+
+type RuntimeEnvironment string
+
+const (
+	CloudFunctionsRuntime = RuntimeEnvironment("cloudfunctions")
+	CloudRunRuntime       = RuntimeEnvironment("cloudrun")
+	CloudRunJobsRuntime   = RuntimeEnvironment("cloudrunjobs")
+	LocalRuntime          = RuntimeEnvironment("local")
+	UnknownRuntime        = RuntimeEnvironment("unknown")
+)
+
+// runEndpoint is the regional Cloud Run API endpoint, formatted with the
+// region, the API group and version, and the resource name.
+var runEndpoint = "https://%s-run.googleapis.com/apis/%s/%s"
+
+// functionsEndpoint is the Cloud Functions API endpoint.
+var functionsEndpoint = "https://cloudfunctions.googleapis.com/"
+
+// The Cloud Run API groups serving services and jobs.
+const (
+	servingAPI = "serving.knative.dev/v1"
+	runAPI     = "run.googleapis.com/v1"
+)
+
+// A RuntimeDetector detects a runtime environment and lists the
+// environment variables declared for the workload running in it.
+type RuntimeDetector interface {
+	// Detect reports whether the process is running in the runtime
+	// environment handled by the detector.
+	Detect() (RuntimeEnvironment, bool)
+
+	// EnvironmentVariables returns the environment variables declared
+	// for the running workload.
+	EnvironmentVariables(ctx context.Context) (map[string]string, error)
+}
+
+var (
+	runtimesMu sync.RWMutex
+	runtimes   []RuntimeDetector
+)
+
+// 2nd gen Cloud Functions run on Cloud Run and set K_SERVICE, so the
+// Cloud Functions detector is registered after, and consulted before, the
+// Cloud Run detector.
+func init() {
+	RegisterRuntime(cloudRunDetector{})
+	RegisterRuntime(cloudRunJobsDetector{})
+	RegisterRuntime(cloudFunctionsDetector{})
+	RegisterRuntime(localDetector{})
+}
+
+// RegisterRuntime adds a runtime detector. Detectors are consulted in
+// the reverse order they were registered, so a detector registered later
+// takes precedence over the built-in detectors.
+func RegisterRuntime(d RuntimeDetector) {
+	runtimesMu.Lock()
+	defer runtimesMu.Unlock()
+
+	if d == nil {
+		panic("konfig: RegisterRuntime detector is nil")
+	}
+	runtimes = append([]RuntimeDetector{d}, runtimes...)
+}
+
+// detectRuntime returns the first registered detector that detects its
+// runtime environment.
+func detectRuntime() (RuntimeEnvironment, RuntimeDetector) {
+	runtimesMu.RLock()
+	defer runtimesMu.RUnlock()
+
+	for _, d := range runtimes {
+		if e, ok := d.Detect(); ok {
+			return e, d
+		}
+	}
+	return UnknownRuntime, nil
+}
+
+type cloudFunctionsDetector struct{}
+
+// Detect reports whether the process runs as a 1st gen function on an
+// older runtime, which sets FUNCTION_NAME, or as a function on a newer
+// runtime or 2nd gen, which sets FUNCTION_TARGET and K_SERVICE.
+func (cloudFunctionsDetector) Detect() (RuntimeEnvironment, bool) {
+	if os.Getenv("FUNCTION_NAME") != "" {
+		return CloudFunctionsRuntime, true
+	}
+	return CloudFunctionsRuntime, os.Getenv("FUNCTION_TARGET") != "" && os.Getenv("K_SERVICE") != ""
+}
+
+// EnvironmentVariables returns the environment variables of the function
+// read with the Cloud Functions v2 API, which keeps the environment
+// variables of 2nd gen functions in the service config. 1st gen
+// functions are read with the v1 API. If the APIs do not know the
+// function or may not be used, it is read as a Cloud Run service.
+func (cloudFunctionsDetector) EnvironmentVariables(ctx context.Context) (map[string]string, error) {
+	s := sessionFromContext(ctx)
+
+	_, httpClient, err := s.credentials()
+	if err != nil {
+		return nil, err
+	}
+
+	name, err := functionName(s)
+	if err != nil {
+		return nil, err
+	}
+
+	// Cloud Run services built with the Functions Framework set
+	// FUNCTION_TARGET and K_SERVICE too, but are not functions and often
+	// may not use the Cloud Functions API. Only 1st gen functions on
+	// older runtimes set FUNCTION_NAME.
+	isFunction := os.Getenv("FUNCTION_NAME") != ""
+
+	var function Function
+	status, err := getResource(ctx, httpClient, functionsEndpoint+"v2/"+name, &function)
+	if status == http.StatusForbidden && !isFunction {
+		return cloudRunDetector{}.EnvironmentVariables(ctx)
+	}
+	if err != nil && status != http.StatusNotFound {
+		return nil, err
+	}
+	if err == nil && function.Environment != "GEN_1" {
+		return function.ServiceConfig.EnvironmentVariables, nil
+	}
+
+	client, err := cloudfunctions.New(httpClient)
+	if err != nil {
+		return nil, err
+	}
+	client.BasePath = functionsEndpoint
+	client.UserAgent = userAgent
+
+	cloudFunction, err := client.Projects.Locations.Functions.Get(name).Context(ctx).Do()
+	if e, ok := err.(*googleapi.Error); ok && (e.Code == http.StatusNotFound || e.Code == http.StatusForbidden) && !isFunction {
+		return cloudRunDetector{}.EnvironmentVariables(ctx)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return cloudFunction.EnvironmentVariables, nil
+}
+
+type cloudRunDetector struct{}
+
+func (cloudRunDetector) Detect() (RuntimeEnvironment, bool) {
+	return CloudRunRuntime, os.Getenv("K_SERVICE") != ""
+}
+
+// EnvironmentVariables returns the environment variables of the revision
+// named by K_REVISION, so every instance uses the env vars it was
+// deployed with even while a newer revision rolls out. The template of
+// the service is used if the revision is unknown.
+func (cloudRunDetector) EnvironmentVariables(ctx context.Context) (map[string]string, error) {
+	s := sessionFromContext(ctx)
+
+	_, httpClient, err := s.credentials()
+	if err != nil {
+		return nil, err
+	}
+
+	project, err := s.project()
+	if err != nil {
+		return nil, err
+	}
+
+	region, err := s.region()
+	if err != nil {
+		return nil, err
+	}
+
+	var spec RevisionSpec
+	status := http.StatusNotFound
+	if os.Getenv("K_REVISION") != "" {
+		var revision Revision
+		status, err = getResource(ctx, httpClient, fmt.Sprintf(runEndpoint, region, servingAPI, revisionName(project)), &revision)
+		spec = revision.Spec
+	}
+	if status == http.StatusNotFound {
+		var service Service
+		_, err = getResource(ctx, httpClient, fmt.Sprintf(runEndpoint, region, servingAPI, serviceName(project)), &service)
+		spec = service.Spec.RevisionTemplate.Spec
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return containerEnvironmentVariables(spec.Containers)
+}
+
+type cloudRunJobsDetector struct{}
+
+func (cloudRunJobsDetector) Detect() (RuntimeEnvironment, bool) {
+	return CloudRunJobsRuntime, os.Getenv("CLOUD_RUN_JOB") != ""
+}
+
+// EnvironmentVariables returns the environment variables of the task
+// template of the execution named by CLOUD_RUN_EXECUTION, which holds any
+// overrides the execution was started with. The task template of the job
+// is used if the execution is unknown.
+func (cloudRunJobsDetector) EnvironmentVariables(ctx context.Context) (map[string]string, error) {
+	s := sessionFromContext(ctx)
+
+	_, httpClient, err := s.credentials()
+	if err != nil {
+		return nil, err
+	}
+
+	project, err := s.project()
+	if err != nil {
+		return nil, err
+	}
+
+	region, err := s.region()
+	if err != nil {
+		return nil, err
+	}
+
+	var spec TaskSpec
+	status := http.StatusNotFound
+	if os.Getenv("CLOUD_RUN_EXECUTION") != "" {
+		var execution Execution
+		status, err = getResource(ctx, httpClient, fmt.Sprintf(runEndpoint, region, runAPI, executionName(project)), &execution)
+		spec = execution.Spec.Template.Spec
+	}
+	if status == http.StatusNotFound {
+		var job Job
+		_, err = getResource(ctx, httpClient, fmt.Sprintf(runEndpoint, region, runAPI, jobName(project)), &job)
+		spec = job.Spec.Template.Spec.Template.Spec
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return containerEnvironmentVariables(spec.Containers)
+}
+
+// containerEnvironmentVariables returns the environment variables of the
+// container konfig runs in. Variables set with valueFrom are resolved by
+// Cloud Run before the container starts, so their values are read from
+// the process environment.
+func containerEnvironmentVariables(containers []Container) (map[string]string, error) {
+	container, err := currentContainer(containers)
+	if err != nil {
+		return nil, err
+	}
+
+	environmentVariables := make(map[string]string)
+	for _, env := range container.Env {
+		if env.ValueFrom != nil {
+			if value, ok := os.LookupEnv(env.Name); ok {
+				environmentVariables[env.Name] = value
+			}
+			continue
+		}
+		environmentVariables[env.Name] = env.Value
+	}
+	return environmentVariables, nil
+}
+
+// currentContainer returns the container named by the KONFIG_CONTAINER
+// environment variable, the only container, or the ingress container,
+// which is the only container that declares a port.
+func currentContainer(containers []Container) (*Container, error) {
+	if name := os.Getenv("KONFIG_CONTAINER"); name != "" {
+		for i := range containers {
+			if containers[i].Name == name {
+				return &containers[i], nil
+			}
+		}
+		return nil, fmt.Errorf("konfig: container %q not found", name)
+	}
+
+	if len(containers) == 1 {
+		return &containers[0], nil
+	}
+
+	var ingress []*Container
+	for i := range containers {
+		if len(containers[i].Ports) > 0 {
+			ingress = append(ingress, &containers[i])
+		}
+	}
+	if len(ingress) != 1 {
+		return nil, fmt.Errorf("konfig: unable to select one of %d containers, set KONFIG_CONTAINER", len(containers))
+	}
+	return ingress[0], nil
+}
+
+// getResource reads the Cloud Run or Cloud Functions API resource at url
+// into v. It returns the HTTP status code of the response, and an error
+// including the message of the API for every status other than 200.
+func getResource(ctx context.Context, client *http.Client, url string, v interface{}) (int, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return resp.StatusCode, err
+	}
+
+	if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+		if email, err := sessionFromContext(ctx).serviceAccount(); err == nil {
+			return resp.StatusCode, fmt.Errorf("%w: GET %s as %s", ErrForbidden, url, email)
+		}
+		return resp.StatusCode, fmt.Errorf("%w: GET %s", ErrForbidden, url)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		var status struct {
+			Error struct {
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		if json.Unmarshal(data, &status) == nil && status.Error.Message != "" {
+			return resp.StatusCode, fmt.Errorf("konfig: GET %s: %s: %s", url, resp.Status, status.Error.Message)
+		}
+		return resp.StatusCode, fmt.Errorf("konfig: GET %s: %s", url, resp.Status)
+	}
+
+	if err := json.Unmarshal(data, v); err != nil {
+		return resp.StatusCode, fmt.Errorf("%w: %s: %v", ErrDecode, url, err)
+	}
+	return resp.StatusCode, nil
+}
+
+// localDetector enables local development. It is selected by setting
+// KONFIG_RUNTIME=local and resolves references found in the process
+// environment using the current kubeconfig file.
+type localDetector struct{}
+
+func (localDetector) Detect() (RuntimeEnvironment, bool) {
+	return LocalRuntime, os.Getenv("KONFIG_RUNTIME") == string(LocalRuntime)
+}
+
+func (localDetector) EnvironmentVariables(ctx context.Context) (map[string]string, error) {
+	environmentVariables := make(map[string]string)
+	for _, kv := range os.Environ() {
+		if i := strings.Index(kv, "="); i > 0 {
+			environmentVariables[kv[:i]] = kv[i+1:]
+		}
+	}
+	return environmentVariables, nil
+}
+
+func serviceName(project string) string {
+	service := os.Getenv("K_SERVICE")
+	return fmt.Sprintf("namespaces/%s/services/%s", project, service)
+}
+
+func revisionName(project string) string {
+	revision := os.Getenv("K_REVISION")
+	return fmt.Sprintf("namespaces/%s/revisions/%s", project, revision)
+}
+
+func jobName(project string) string {
+	job := os.Getenv("CLOUD_RUN_JOB")
+	return fmt.Sprintf("namespaces/%s/jobs/%s", project, job)
+}
+
+func executionName(project string) string {
+	execution := os.Getenv("CLOUD_RUN_EXECUTION")
+	return fmt.Sprintf("namespaces/%s/executions/%s", project, execution)
+}
+
+// functionName returns the resource name of the running function. Newer
+// runtimes don't set FUNCTION_NAME, so the name is taken from K_SERVICE
+// instead.
+func functionName(s *session) (string, error) {
+	name := os.Getenv("FUNCTION_NAME")
+	if name == "" {
+		name = os.Getenv("K_SERVICE")
+	}
+
+	project, err := s.project()
+	if err != nil {
+		return "", err
+	}
+
+	region, err := s.region()
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("projects/%s/locations/%s/functions/%s", project, region, name), nil
+}
@@ -0,0 +1,129 @@
+package konfig
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+)
+
+// fakeRuntime is a runtime declaring a fixed set of environment
+// variables. Its environment defaults to "fake".
+type fakeRuntime struct {
+	environment RuntimeEnvironment
+	env         map[string]string
+}
+
+func (r *fakeRuntime) Detect() (RuntimeEnvironment, bool) {
+	if r.environment == "" {
+		return RuntimeEnvironment("fake"), true
+	}
+	return r.environment, true
+}
+
+func (r *fakeRuntime) EnvironmentVariables(ctx context.Context) (map[string]string, error) {
+	return r.env, nil
+}
+
+func TestLoadWithRuntime(t *testing.T) {
+	defer os.Unsetenv("KONFIG_TEST_FOO")
+	defer os.Unsetenv("KONFIG_TEST_MISSING")
+
+	runtime := &fakeRuntime{
+		env: map[string]string{
+			"KONFIG_TEST_FOO":     "$TestRef:foo",
+			"KONFIG_TEST_MISSING": "$TestRef:missing",
+			"KONFIG_TEST_PLAIN":   "plain",
+		},
+	}
+
+	result, err := Load(context.Background(), Options{Runtime: runtime})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result.Runtime != "fake" {
+		t.Errorf("want fake runtime, got %s", result.Runtime)
+	}
+	if len(result.Variables) != 2 {
+		t.Fatalf("want 2 variables, got %d", len(result.Variables))
+	}
+	if v := result.Variables[0]; v.Name != "KONFIG_TEST_FOO" || v.Status != Resolved {
+		t.Errorf("unexpected variable %+v", v)
+	}
+	if v := result.Variables[1]; v.Name != "KONFIG_TEST_MISSING" || v.Status != Failed {
+		t.Errorf("unexpected variable %+v", v)
+	}
+	if got := os.Getenv("KONFIG_TEST_FOO"); got != "bar" {
+		t.Errorf("want bar, got %s", got)
+	}
+}
+
+func TestDetectRuntime(t *testing.T) {
+	saved := runtimes
+	defer func() { runtimes = saved }()
+
+	RegisterRuntime(&fakeRuntime{})
+
+	e, d := detectRuntime()
+	if e != "fake" || d == nil {
+		t.Errorf("want registered fake runtime, got %s", e)
+	}
+}
+
+func TestLoadDefaultAndOptional(t *testing.T) {
+	defer os.Unsetenv("KONFIG_TEST_DEFAULT")
+	defer os.Unsetenv("KONFIG_TEST_OPTIONAL")
+	defer os.Unsetenv("KONFIG_TEST_FOUND")
+
+	runtime := &fakeRuntime{
+		env: map[string]string{
+			"KONFIG_TEST_DEFAULT":  "$TestRef:missing?default=fallback",
+			"KONFIG_TEST_OPTIONAL": "$TestRef:missing?optional=true",
+			"KONFIG_TEST_FOUND":    "$TestRef:foo?default=fallback",
+		},
+	}
+	os.Setenv("KONFIG_TEST_OPTIONAL", "$TestRef:missing?optional=true")
+
+	result, err := Load(context.Background(), Options{Runtime: runtime})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := result.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := os.Getenv("KONFIG_TEST_DEFAULT"); got != "fallback" {
+		t.Errorf("want fallback, got %s", got)
+	}
+	if got := os.Getenv("KONFIG_TEST_FOUND"); got != "bar" {
+		t.Errorf("want bar, got %s", got)
+	}
+	if v, ok := os.LookupEnv("KONFIG_TEST_OPTIONAL"); ok {
+		t.Errorf("want KONFIG_TEST_OPTIONAL unset, got %s", v)
+	}
+	if v := result.Variables[2]; v.Name != "KONFIG_TEST_OPTIONAL" || v.Status != Skipped {
+		t.Errorf("unexpected variable %+v", v)
+	}
+}
+
+func TestLoadStrict(t *testing.T) {
+	defer os.Unsetenv("KONFIG_TEST_FOO")
+	defer os.Unsetenv("KONFIG_TEST_MISSING")
+
+	runtime := &fakeRuntime{
+		env: map[string]string{
+			"KONFIG_TEST_FOO":     "$TestRef:foo",
+			"KONFIG_TEST_MISSING": "$TestRef:missing",
+		},
+	}
+
+	_, err := Load(context.Background(), Options{Runtime: runtime, Strict: true})
+	errs, ok := err.(ReferenceErrors)
+	if !ok || len(errs) != 1 || errs[0].Name != "KONFIG_TEST_MISSING" {
+		t.Fatalf("want one error for KONFIG_TEST_MISSING, got %v", err)
+	}
+	if !errors.Is(errs[0], ErrKeyNotFound) {
+		t.Errorf("want ErrKeyNotFound, got %v", errs[0])
+	}
+}
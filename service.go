@@ -12,6 +12,10 @@ type ServiceSpec struct {
 	RevisionTemplate RevisionTemplate `json:"template,omitempty"`
 }
 
+type Revision struct {
+	Spec RevisionSpec `json:"spec,omitempty"`
+}
+
 type RevisionTemplate struct {
 	Spec RevisionSpec `json:"spec,omitempty"`
 }
@@ -21,10 +25,69 @@ type RevisionSpec struct {
 }
 
 type Container struct {
-	Env []EnvVar `json:"env,omitempty"`
+	Name  string          `json:"name,omitempty"`
+	Env   []EnvVar        `json:"env,omitempty"`
+	Ports []ContainerPort `json:"ports,omitempty"`
+}
+
+type ContainerPort struct {
+	Name          string `json:"name,omitempty"`
+	ContainerPort int32  `json:"containerPort,omitempty"`
 }
 
 type EnvVar struct {
-	Name  string `json:"name"`
-	Value string `json:"value,omitempty"`
+	Name      string        `json:"name"`
+	Value     string        `json:"value,omitempty"`
+	ValueFrom *EnvVarSource `json:"valueFrom,omitempty"`
+}
+
+// EnvVarSource is the source of an environment variable Cloud Run
+// resolves itself, such as a Secret Manager secret.
+type EnvVarSource struct {
+	ConfigMapKeyRef *KeySelector `json:"configMapKeyRef,omitempty"`
+	SecretKeyRef    *KeySelector `json:"secretKeyRef,omitempty"`
+}
+
+type KeySelector struct {
+	Name     string `json:"name,omitempty"`
+	Key      string `json:"key"`
+	Optional bool   `json:"optional,omitempty"`
+}
+
+type Job struct {
+	Spec JobSpec `json:"spec,omitempty"`
+}
+
+type JobSpec struct {
+	Template ExecutionTemplate `json:"template,omitempty"`
+}
+
+type ExecutionTemplate struct {
+	Spec ExecutionSpec `json:"spec,omitempty"`
+}
+
+type Execution struct {
+	Spec ExecutionSpec `json:"spec,omitempty"`
+}
+
+type ExecutionSpec struct {
+	Template TaskTemplate `json:"template,omitempty"`
+}
+
+type TaskTemplate struct {
+	Spec TaskSpec `json:"spec,omitempty"`
+}
+
+type TaskSpec struct {
+	Containers []Container `json:"containers"`
+}
+
+// Function is a Cloud Functions v2 API function.
+type Function struct {
+	Environment   string        `json:"environment,omitempty"`
+	ServiceConfig ServiceConfig `json:"serviceConfig,omitempty"`
+}
+
+type ServiceConfig struct {
+	EnvironmentVariables map[string]string `json:"environmentVariables,omitempty"`
 }
@@ -0,0 +1,172 @@
+// Copyright 2019 The Konfig Authors. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+
+package konfig
+
+import (
+	"context"
+	"net/http"
+	"sync"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+)
+
+// A session holds the state shared by the references resolved during a
+// single call to Load. It is carried to runtime detectors and providers
+// in the context.
+type session struct {
+	runtime    RuntimeEnvironment
+	regionName string
+
+	// defaultCredentials reports whether the application default
+	// credentials are used rather than Options.TokenSource.
+	defaultCredentials bool
+
+	once        sync.Once
+	tokenSource oauth2.TokenSource
+	httpClient  *http.Client
+	err         error
+
+	mu      sync.Mutex
+	entries map[string]*sessionEntry
+}
+
+// A sessionEntry holds a value computed once per session, such as the
+// connection to a cluster or a fetched secret.
+type sessionEntry struct {
+	once  sync.Once
+	value interface{}
+	err   error
+}
+
+type sessionKey struct{}
+
+func newSession(e RuntimeEnvironment, opts Options) *session {
+	return &session{
+		runtime:            e,
+		regionName:         opts.Region,
+		defaultCredentials: opts.TokenSource == nil,
+		tokenSource:        opts.TokenSource,
+	}
+}
+
+func withSession(ctx context.Context, s *session) context.Context {
+	return context.WithValue(ctx, sessionKey{}, s)
+}
+
+// sessionFromContext returns the session carried by ctx, or a new
+// session using the application default credentials.
+func sessionFromContext(ctx context.Context) *session {
+	if s, ok := ctx.Value(sessionKey{}).(*session); ok {
+		return s
+	}
+	return &session{}
+}
+
+// credentials returns the token source and OAuth2 HTTP client used to
+// call Google Cloud APIs. The application default credentials are only
+// looked up the first time they are needed, so runtimes and providers
+// that don't call Google Cloud APIs work without them.
+func (s *session) credentials() (oauth2.TokenSource, *http.Client, error) {
+	s.once.Do(func() {
+		if s.tokenSource == nil {
+			s.tokenSource, s.err = defaultTokenSource()
+			if s.err != nil {
+				return
+			}
+		}
+		s.httpClient = oauth2.NewClient(context.Background(), s.tokenSource)
+	})
+	return s.tokenSource, s.httpClient, s.err
+}
+
+// do returns the value computed by fn for key, calling fn the first time
+// key is seen during the session. Concurrent callers for the same key
+// share a single call.
+func (s *session) do(key string, fn func() (interface{}, error)) (interface{}, error) {
+	s.mu.Lock()
+	if s.entries == nil {
+		s.entries = make(map[string]*sessionEntry)
+	}
+	e, ok := s.entries[key]
+	if !ok {
+		e = &sessionEntry{}
+		s.entries[key] = e
+	}
+	s.mu.Unlock()
+
+	e.once.Do(func() {
+		e.value, e.err = fn()
+	})
+	return e.value, e.err
+}
+
+// A clusterConn holds the API server URL and HTTP client of a Kubernetes
+// cluster.
+type clusterConn struct {
+	server string
+	client *http.Client
+}
+
+// cluster returns the API server URL and HTTP client for the cluster
+// identified by key, calling connect the first time key is seen during
+// the session.
+func (s *session) cluster(key string, connect func() (string, *http.Client, error)) (string, *http.Client, error) {
+	v, err := s.do("cluster:"+key, func() (interface{}, error) {
+		server, client, err := connect()
+		return &clusterConn{server: server, client: client}, err
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	c := v.(*clusterConn)
+	return c.server, c.client, nil
+}
+
+var (
+	defaultTokenSourceMu sync.Mutex
+	defaultTS            oauth2.TokenSource
+
+	transportsMu sync.Mutex
+	transports   = make(map[string]*http.Transport)
+)
+
+// defaultTokenSource returns a token source for the application default
+// credentials. It is shared across sessions so cached tokens are reused.
+func defaultTokenSource() (oauth2.TokenSource, error) {
+	defaultTokenSourceMu.Lock()
+	defer defaultTokenSourceMu.Unlock()
+
+	if defaultTS != nil {
+		return defaultTS, nil
+	}
+
+	ts, err := google.DefaultTokenSource(context.Background(), cloudPlatformScope)
+	if err != nil {
+		return nil, err
+	}
+	defaultTS = ts
+	return ts, nil
+}
+
+// sharedTransport returns the transport cached under key, calling
+// newTransport to create it if needed. Transports are shared across
+// sessions so connections to Kubernetes API servers are kept alive
+// between calls to Load.
+func sharedTransport(key string, newTransport func() (*http.Transport, error)) (*http.Transport, error) {
+	transportsMu.Lock()
+	defer transportsMu.Unlock()
+
+	if tr, ok := transports[key]; ok {
+		return tr, nil
+	}
+
+	tr, err := newTransport()
+	if err != nil {
+		return nil, err
+	}
+	transports[key] = tr
+	return tr, nil
+}
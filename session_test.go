@@ -0,0 +1,49 @@
+package konfig
+
+import (
+	"net/http"
+	"sync"
+	"testing"
+)
+
+func TestSessionClusterConnectsOnce(t *testing.T) {
+	s := &session{}
+
+	var mu sync.Mutex
+	calls := 0
+	connect := func() (string, *http.Client, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		calls++
+		return "https://10.0.0.1", http.DefaultClient, nil
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			server, _, err := s.cluster("/projects/p/zones/z/clusters/c", connect)
+			if err != nil || server != "https://10.0.0.1" {
+				t.Errorf("unexpected cluster %s: %v", server, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if calls != 1 {
+		t.Errorf("want 1 cluster lookup, got %d", calls)
+	}
+}
+
+func TestSharedTransport(t *testing.T) {
+	newTransport := func() (*http.Transport, error) {
+		return &http.Transport{}, nil
+	}
+
+	a, _ := sharedTransport("test-cluster", newTransport)
+	b, _ := sharedTransport("test-cluster", newTransport)
+	if a != b {
+		t.Error("want transport to be reused")
+	}
+}
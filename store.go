@@ -0,0 +1,50 @@
+// Copyright 2019 The Konfig Authors. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+
+package konfig
+
+import "sync"
+
+// valueStore holds the resolved value of every environment variable
+// that held a reference.
+type valueStore struct {
+	mu     sync.RWMutex
+	values map[string]string
+}
+
+var store = &valueStore{values: make(map[string]string)}
+
+func (s *valueStore) set(name, value string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.values[name] = value
+}
+
+func (s *valueStore) delete(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.values, name)
+}
+
+func (s *valueStore) lookup(name string) (string, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	v, ok := s.values[name]
+	return v, ok
+}
+
+// Lookup returns the resolved value of the named environment variable.
+// For tempFile references the value is the path to the temp file. If the
+// variable did not hold a reference, or the reference has not been
+// resolved, ok is false.
+func Lookup(name string) (value string, ok bool) {
+	return store.lookup(name)
+}
+
+// Get returns the resolved value of the named environment variable, or
+// an empty string if it has not been resolved.
+func Get(name string) string {
+	v, _ := store.lookup(name)
+	return v
+}
@@ -0,0 +1,41 @@
+package konfig
+
+import (
+	"context"
+	"os"
+	"testing"
+)
+
+func TestLoadSkipSetenv(t *testing.T) {
+	env := map[string]string{
+		"KONFIG_TEST_STORE":  "$TestRef:foo",
+		"KONFIG_TEST_SETENV": "$TestRef:foo?setenv=true",
+	}
+	os.Setenv("KONFIG_TEST_STORE", env["KONFIG_TEST_STORE"])
+	defer os.Unsetenv("KONFIG_TEST_STORE")
+	defer os.Unsetenv("KONFIG_TEST_SETENV")
+
+	result, err := Load(context.Background(), Options{
+		Runtime:    &fakeRuntime{env: env},
+		SkipSetenv: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := result.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	if v, ok := Lookup("KONFIG_TEST_STORE"); !ok || v != "bar" {
+		t.Errorf("want bar, got %q", v)
+	}
+	if got := os.Getenv("KONFIG_TEST_STORE"); got != env["KONFIG_TEST_STORE"] {
+		t.Errorf("want environment to hold the reference, got %s", got)
+	}
+	if got := os.Getenv("KONFIG_TEST_SETENV"); got != "bar" {
+		t.Errorf("want setenv option to override SkipSetenv, got %q", got)
+	}
+	if _, ok := Lookup("KONFIG_TEST_UNKNOWN"); ok {
+		t.Error("want unknown variable to be missing")
+	}
+}
@@ -0,0 +1,293 @@
+// Copyright 2019 The Konfig Authors. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+
+package konfig
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+const defaultFileMode = 0600
+
+// fileOptions holds the tempFile and tempDir reference options that
+// control where and how files are written.
+type fileOptions struct {
+	dir     string
+	name    string
+	pattern string
+	mode    os.FileMode
+}
+
+// parseFileOptions returns the file options of r. The supported
+// options are:
+//
+//	fileMode      the octal permissions of written files, 0600 by default
+//	dir           the directory files are created in, os.TempDir by default
+//	fileName      a fixed file name instead of a random one
+//	keepExtension keep the extension of the key, such as .json
+func parseFileOptions(r *Reference) (fileOptions, error) {
+	opts := fileOptions{
+		dir:  r.Query.Get("dir"),
+		name: r.Query.Get("fileName"),
+		mode: defaultFileMode,
+	}
+
+	if v := r.Query.Get("fileMode"); v != "" {
+		mode, err := strconv.ParseUint(v, 8, 32)
+		if err != nil || mode > 0777 {
+			return opts, fmt.Errorf("%w: fileMode=%s", ErrInvalidReference, v)
+		}
+		opts.mode = os.FileMode(mode)
+	}
+
+	if opts.name != "" && !validFileName(opts.name) {
+		return opts, fmt.Errorf("%w: fileName=%s", ErrInvalidReference, opts.name)
+	}
+
+	if v := r.Query.Get("keepExtension"); v != "" {
+		keep, err := strconv.ParseBool(v)
+		if err != nil {
+			return opts, fmt.Errorf("%w: keepExtension=%s", ErrInvalidReference, v)
+		}
+		if keep {
+			opts.pattern = "*" + filepath.Ext(r.Key)
+		}
+	}
+
+	return opts, nil
+}
+
+// writeTempFile writes the value of the named variable to the file
+// configured by the reference options and returns its path. The file
+// created when the variable was first resolved is reused and its
+// contents replaced atomically.
+func writeTempFile(name string, r *Reference, data []byte) (string, error) {
+	opts, err := parseFileOptions(r)
+	if err != nil {
+		return "", err
+	}
+
+	// Reuse the file written when the variable was last resolved,
+	// unless the options moved it.
+	path := state.tempFile(name)
+	if opts.name != "" {
+		path = filepath.Join(dirOrTempDir(opts.dir), opts.name)
+	} else if path != "" && filepath.Dir(path) != filepath.Clean(dirOrTempDir(opts.dir)) {
+		path = ""
+	}
+
+	if path != "" {
+		if err := writeFileAtomic(path, data, opts.mode); err != nil {
+			return "", err
+		}
+		state.setTempFile(name, path)
+		return path, nil
+	}
+
+	f, err := createFile(dirOrTempDir(opts.dir), opts.pattern, opts.mode)
+	if err != nil {
+		return "", err
+	}
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return "", err
+	}
+
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+
+	state.setTempFile(name, f.Name())
+	return f.Name(), nil
+}
+
+// writeTempDir writes every key of object to its own file in a private
+// temp directory, like a Kubernetes volume mount, and returns the path to
+// the directory. The directory created when the named variable was first
+// resolved is reused, its files are replaced atomically and files for
+// keys no longer in object are removed.
+func writeTempDir(name string, r *Reference, object map[string][]byte) (string, error) {
+	opts, err := parseFileOptions(r)
+	if err != nil {
+		return "", err
+	}
+
+	for key := range object {
+		if !validFileName(key) {
+			return "", fmt.Errorf("%w: key %q is not a valid file name", ErrInvalidReference, key)
+		}
+	}
+
+	dir := state.tempFile(name)
+	if dir != "" && filepath.Dir(dir) != filepath.Clean(dirOrTempDir(opts.dir)) {
+		dir = ""
+	}
+	if dir == "" {
+		dir, err = ioutil.TempDir(opts.dir, "konfig")
+		if err != nil {
+			return "", err
+		}
+		state.setTempFile(name, dir)
+	}
+
+	for key, data := range object {
+		if err := writeFileAtomic(filepath.Join(dir, key), data, opts.mode); err != nil {
+			return "", err
+		}
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return "", err
+	}
+	for _, f := range files {
+		if _, ok := object[f.Name()]; !ok {
+			if err := os.Remove(filepath.Join(dir, f.Name())); err != nil {
+				return "", err
+			}
+		}
+	}
+
+	return dir, nil
+}
+
+// writesFile reports whether r uses the tempFile or tempDir options.
+func writesFile(r *Reference) bool {
+	return r != nil && (r.Query.Get("tempFile") != "" || r.Query.Get("tempDir") != "")
+}
+
+// Cleanup removes every temp file and directory written for tempFile and
+// tempDir references. Programs should call it during graceful shutdown,
+// so secrets do not outlive the process on the instance's in-memory file
+// system. It returns the first error encountered.
+func Cleanup() error {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+
+	var err error
+	for name, path := range state.tempFiles {
+		if e := os.RemoveAll(path); e != nil && err == nil {
+			err = e
+		}
+		delete(state.tempFiles, name)
+	}
+	return err
+}
+
+var cleanupOnSignalOnce sync.Once
+
+// cleanupOnSignal calls Cleanup when the process receives SIGTERM or
+// SIGINT, then exits with the status a shell reports for the signal. The
+// signal is not delivered again, so it is only suitable for programs that
+// do not handle these signals themselves.
+func cleanupOnSignal() {
+	cleanupOnSignalOnce.Do(func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+
+		go func() {
+			sig := <-signals
+			Cleanup()
+			os.Exit(exitStatus(sig))
+		}()
+	})
+}
+
+// exitStatus returns 128 plus the number of sig, like a shell does for a
+// process killed by a signal.
+func exitStatus(sig os.Signal) int {
+	if s, ok := sig.(syscall.Signal); ok {
+		return 128 + int(s)
+	}
+	return 1
+}
+
+// writeFileAtomic replaces the contents of the named file by writing data
+// to a new file in the same directory and renaming it over the original,
+// so readers never see a partially written file.
+func writeFileAtomic(name string, data []byte, mode os.FileMode) error {
+	f, err := createFile(filepath.Dir(name), "."+filepath.Base(name)+"*", mode)
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+
+	if err := os.Rename(f.Name(), name); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+
+	return nil
+}
+
+// createFile creates a new file with the given permissions in dir. Like
+// ioutil.TempFile, the last "*" in pattern is replaced by a random string,
+// which is appended if pattern has no "*". Unlike ioutil.TempFile the
+// file is created with mode rather than 0600, regardless of the umask.
+func createFile(dir, pattern string, mode os.FileMode) (*os.File, error) {
+	prefix, suffix := pattern, ""
+	if i := strings.LastIndex(pattern, "*"); i >= 0 {
+		prefix, suffix = pattern[:i], pattern[i+1:]
+	}
+
+	for i := 0; i < 10000; i++ {
+		b := make([]byte, 6)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+
+		name := filepath.Join(dir, prefix+hex.EncodeToString(b)+suffix)
+		f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode)
+		if os.IsExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		// OpenFile applies the umask, so the mode is set again before
+		// any data is written.
+		if err := f.Chmod(mode); err != nil {
+			f.Close()
+			os.Remove(name)
+			return nil, err
+		}
+		return f, nil
+	}
+	return nil, fmt.Errorf("konfig: unable to create file in %s", dir)
+}
+
+func dirOrTempDir(dir string) string {
+	if dir == "" {
+		return os.TempDir()
+	}
+	return dir
+}
+
+func validFileName(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.ContainsAny(name, `/\`)
+}
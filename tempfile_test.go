@@ -0,0 +1,173 @@
+package konfig
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestLoadTempFileOptions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "konfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	testProvider.set("config.json", `{"debug":true}`)
+
+	env := map[string]string{
+		"KONFIG_TEST_JSON_CONFIG": "$TestRef:config.json?tempFile=true&keepExtension=true&fileMode=0400&dir=" + dir,
+		"KONFIG_TEST_NAMED":       "$TestRef:config.json?tempFile=true&fileName=app.json&dir=" + dir,
+		"KONFIG_TEST_SHARED":      "$TestRef:config.json?tempFile=true&fileMode=0644&dir=" + dir,
+	}
+	defer os.Unsetenv("KONFIG_TEST_JSON_CONFIG")
+	defer os.Unsetenv("KONFIG_TEST_NAMED")
+	defer os.Unsetenv("KONFIG_TEST_SHARED")
+
+	// The requested mode is used even if the umask removes its bits.
+	defer syscall.Umask(syscall.Umask(077))
+
+	result, err := Load(context.Background(), Options{Runtime: &fakeRuntime{env: env}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := result.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	path := os.Getenv("KONFIG_TEST_JSON_CONFIG")
+	if filepath.Dir(path) != dir || !strings.HasSuffix(path, ".json") {
+		t.Errorf("want a .json file in %s, got %s", dir, path)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0400 {
+		t.Errorf("want mode 0400, got %v", info.Mode().Perm())
+	}
+
+	info, err = os.Stat(os.Getenv("KONFIG_TEST_SHARED"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0644 {
+		t.Errorf("want mode 0644, got %v", info.Mode().Perm())
+	}
+
+	if got, want := os.Getenv("KONFIG_TEST_NAMED"), filepath.Join(dir, "app.json"); got != want {
+		t.Errorf("want %s, got %s", want, got)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dir, "app.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != `{"debug":true}` {
+		t.Errorf("unexpected contents %s", data)
+	}
+}
+
+func TestParseFileOptionsInvalid(t *testing.T) {
+	for _, query := range []string{"fileMode=0999", "fileMode=10000", "fileName=../etc/passwd", "keepExtension=maybe"} {
+		r, err := parseReference("$TestRef:foo?tempFile=true&" + query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := parseFileOptions(r); err == nil {
+			t.Errorf("%s: want error", query)
+		}
+	}
+}
+
+func TestFileOptionsUnsupported(t *testing.T) {
+	for _, s := range []string{"$TestRef:db/?tempFile=true&fileName=app.json", "$TestRef:db/?tempDir=true&keepExtension=true", "$TestRef:foo?tempDir=true"} {
+		if _, err := parseReference(s); !errors.Is(err, ErrInvalidReference) {
+			t.Errorf("%s: want ErrInvalidReference, got %v", s, err)
+		}
+	}
+	if _, err := parseReference("$TestRef:db/?tempDir=true"); err != nil {
+		t.Errorf("want tempDir on a whole object, got %v", err)
+	}
+}
+
+func TestCleanup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "konfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	testProvider.set("cleanup", "secret")
+
+	env := map[string]string{
+		"KONFIG_TEST_CLEANUP": "$TestRef:cleanup?tempFile=true&dir=" + dir,
+	}
+	defer os.Unsetenv("KONFIG_TEST_CLEANUP")
+
+	opts := Options{Runtime: &fakeRuntime{env: env}}
+	if _, err := Load(context.Background(), opts); err != nil {
+		t.Fatal(err)
+	}
+
+	path := os.Getenv("KONFIG_TEST_CLEANUP")
+	if _, err := os.Stat(path); err != nil {
+		t.Fatal(err)
+	}
+
+	// Moving the file removes the one written before.
+	env["KONFIG_TEST_CLEANUP"] += "&fileName=cleanup.txt"
+	if _, err := Load(context.Background(), opts); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("want %s removed, got %v", path, err)
+	}
+
+	path = os.Getenv("KONFIG_TEST_CLEANUP")
+	if err := Cleanup(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("want %s removed, got %v", path, err)
+	}
+}
+
+func TestCleanupOnSignal(t *testing.T) {
+	if os.Getenv("KONFIG_TEST_SIGNAL_HELPER") == "1" {
+		testProvider.set("signal", "secret")
+		env := map[string]string{"KONFIG_TEST_SIGNAL": "$TestRef:signal?tempFile=true"}
+		if _, err := Load(context.Background(), Options{Runtime: &fakeRuntime{env: env}, CleanupOnSignal: true}); err != nil {
+			os.Exit(2)
+		}
+		fmt.Println(os.Getenv("KONFIG_TEST_SIGNAL"))
+		syscall.Kill(os.Getpid(), syscall.SIGTERM)
+		time.Sleep(10 * time.Second)
+		os.Exit(3)
+	}
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestCleanupOnSignal$")
+	cmd.Env = append(os.Environ(), "KONFIG_TEST_SIGNAL_HELPER=1")
+	out, err := cmd.Output()
+
+	exitErr, ok := err.(*exec.ExitError)
+	if !ok || exitErr.ExitCode() != 128+int(syscall.SIGTERM) {
+		t.Fatalf("want exit status %d, got %v", 128+int(syscall.SIGTERM), err)
+	}
+
+	path := strings.TrimSpace(string(out))
+	if path == "" {
+		t.Fatal("want the temp file path")
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		os.Remove(path)
+		t.Errorf("want %s removed, got %v", path, err)
+	}
+}
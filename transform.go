@@ -0,0 +1,156 @@
+// Copyright 2019 The Konfig Authors. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+
+package konfig
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// parseTransforms validates the decode, format and path options of r.
+func parseTransforms(r *Reference) error {
+	if v := r.Query.Get("decode"); v != "" {
+		for _, d := range strings.Split(v, ",") {
+			if d != "base64" && d != "gzip" {
+				return fmt.Errorf("%w: decode=%s", ErrInvalidReference, v)
+			}
+		}
+	}
+
+	format, path := r.Query.Get("format"), r.Query.Get("path")
+	if format != "" && format != "json" && format != "yaml" {
+		return fmt.Errorf("%w: format=%s", ErrInvalidReference, format)
+	}
+	if (format == "") != (path == "") {
+		return fmt.Errorf("%w: format and path must be set together", ErrInvalidReference)
+	}
+	return nil
+}
+
+// transform applies the decode option of r to data, in order, and then
+// extracts the field named by the path option from the document.
+func transform(r *Reference, data []byte) ([]byte, error) {
+	if v := r.Query.Get("decode"); v != "" {
+		for _, d := range strings.Split(v, ",") {
+			var err error
+			switch d {
+			case "base64":
+				data, err = decodeBase64(data)
+			case "gzip":
+				data, err = decodeGzip(data)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("%w: decode=%s: %v", ErrDecode, d, err)
+			}
+		}
+	}
+
+	if format := r.Query.Get("format"); format != "" {
+		return extractField(format, r.Query.Get("path"), data)
+	}
+	return data, nil
+}
+
+// transformObject applies transform to every key of object.
+func transformObject(r *Reference, object map[string][]byte) (map[string][]byte, error) {
+	transformed := make(map[string][]byte, len(object))
+	for k, v := range object {
+		data, err := transform(r, v)
+		if err != nil {
+			return nil, fmt.Errorf("key %s: %w", k, err)
+		}
+		transformed[k] = data
+	}
+	return transformed, nil
+}
+
+func decodeBase64(data []byte) ([]byte, error) {
+	s := strings.TrimSpace(string(data))
+	d, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return base64.RawStdEncoding.DecodeString(s)
+	}
+	return d, nil
+}
+
+func decodeGzip(data []byte) ([]byte, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	return ioutil.ReadAll(zr)
+}
+
+// extractField returns the field named by the dot separated path from a
+// JSON or YAML document. Strings are returned as is, other values are
+// encoded in the format of the document.
+func extractField(format, path string, data []byte) ([]byte, error) {
+	var doc interface{}
+	var err error
+	if format == "json" {
+		err = decodeJSON(data, &doc)
+	} else {
+		err = yaml.Unmarshal(data, &doc)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: format=%s: %v", ErrDecode, format, err)
+	}
+
+	for _, field := range strings.Split(path, ".") {
+		var ok bool
+		switch v := doc.(type) {
+		case map[string]interface{}:
+			doc, ok = v[field]
+		case map[interface{}]interface{}:
+			doc, ok = v[field]
+		case []interface{}:
+			var i int
+			i, err = strconv.Atoi(field)
+			if ok = err == nil && i >= 0 && i < len(v); ok {
+				doc = v[i]
+			}
+		}
+		if !ok {
+			return nil, fmt.Errorf("%w: path %s", ErrKeyNotFound, path)
+		}
+	}
+
+	if s, ok := doc.(string); ok {
+		return []byte(s), nil
+	}
+	if format == "json" {
+		return json.Marshal(doc)
+	}
+	out, err := yaml.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(out, []byte("\n")), nil
+}
+
+// decodeJSON decodes the JSON document in data into v. Numbers are kept
+// as json.Number, so large integers such as IDs keep every digit.
+func decodeJSON(data []byte, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(v); err != nil {
+		return err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return errors.New("invalid character after top-level value")
+	}
+	return nil
+}
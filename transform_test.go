@@ -0,0 +1,69 @@
+package konfig
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"errors"
+	"testing"
+)
+
+func TestTransform(t *testing.T) {
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write([]byte("compressed"))
+	zw.Close()
+
+	config := `{"database":{"password":"s3cret","port":5432,"hosts":["a","b"]}}`
+	tests := []struct {
+		query string
+		data  string
+		want  string
+	}{
+		{"decode=base64", base64.StdEncoding.EncodeToString([]byte("plain")), "plain"},
+		{"decode=base64,gzip", base64.StdEncoding.EncodeToString(gz.Bytes()), "compressed"},
+		{"format=json&path=database.password", config, "s3cret"},
+		{"format=json&path=database.port", config, "5432"},
+		{"format=json&path=database.hosts.1", config, "b"},
+		{"format=json&path=id", `{"id": 12345678901234567890}`, "12345678901234567890"},
+		{"format=json&path=database", `{"database":{"port":5432,"ratio":0.25}}`, `{"port":5432,"ratio":0.25}`},
+		{"format=yaml&path=database.password", "database:\n  password: s3cret\n", "s3cret"},
+		{"format=yaml&path=database", "database:\n  password: s3cret\n", "password: s3cret"},
+	}
+
+	for _, tt := range tests {
+		r, err := parseReference("$TestRef:foo?" + tt.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := transform(r, []byte(tt.data))
+		if err != nil {
+			t.Errorf("%s: %v", tt.query, err)
+			continue
+		}
+		if string(got) != tt.want {
+			t.Errorf("%s: want %q, got %q", tt.query, tt.want, got)
+		}
+	}
+}
+
+func TestTransformErrors(t *testing.T) {
+	for _, query := range []string{"decode=rot13", "format=xml&path=a", "format=json", "path=a"} {
+		if _, err := parseReference("$TestRef:foo?" + query); !errors.Is(err, ErrInvalidReference) {
+			t.Errorf("%s: want ErrInvalidReference, got %v", query, err)
+		}
+	}
+
+	r, err := parseReference("$TestRef:foo?format=json&path=missing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := transform(r, []byte(`{}`)); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("want ErrKeyNotFound, got %v", err)
+	}
+	for _, data := range []string{`{`, `{} {}`} {
+		if _, err := transform(r, []byte(data)); !errors.Is(err, ErrDecode) {
+			t.Errorf("%s: want ErrDecode, got %v", data, err)
+		}
+	}
+}
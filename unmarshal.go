@@ -0,0 +1,220 @@
+// Copyright 2019 The Konfig Authors. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+
+package konfig
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Errors reported by Unmarshal for a single field.
+var (
+	ErrMissingValue = errors.New("missing value")
+	ErrInvalidValue = errors.New("invalid value")
+)
+
+// A FieldError records a failure to set a single struct field.
+type FieldError struct {
+	Field string
+	Name  string
+	Err   error
+}
+
+func (e *FieldError) Error() string {
+	return fmt.Sprintf("%s (%s): %v", e.Field, e.Name, e.Err)
+}
+
+func (e *FieldError) Unwrap() error {
+	return e.Err
+}
+
+// An UnmarshalError lists every field Unmarshal could not set.
+type UnmarshalError struct {
+	Errors []*FieldError
+}
+
+func (e *UnmarshalError) Error() string {
+	messages := make([]string, 0, len(e.Errors))
+	for _, err := range e.Errors {
+		messages = append(messages, err.Error())
+	}
+	return "konfig: unmarshal: " + strings.Join(messages, "; ")
+}
+
+var (
+	durationType = reflect.TypeOf(time.Duration(0))
+	urlType      = reflect.TypeOf(url.URL{})
+	bytesType    = reflect.TypeOf([]byte(nil))
+)
+
+// Unmarshal sets the fields of the struct pointed to by v from the
+// environment variables named by their konfig tags. Values are read with
+// Lookup, falling back to the process environment for variables that did
+// not hold a reference. A variable still holding a reference that could
+// not be resolved is reported as missing, even for optional fields.
+//
+//	type Config struct {
+//		DatabaseURL *url.URL      `konfig:"DATABASE_URL"`
+//		Port        int           `konfig:"PORT"`
+//		Debug       bool          `konfig:"DEBUG,optional"`
+//		Timeout     time.Duration `konfig:"TIMEOUT,optional"`
+//		Hosts       []string      `konfig:"HOSTS,optional"`
+//		TLSKey      []byte        `konfig:"TLS_KEY"`
+//	}
+//
+// Supported field types are string, bool, integers, floats,
+// time.Duration, url.URL, *url.URL, []byte, and slices of those types,
+// which are read as comma separated lists. Untagged struct fields are
+// unmarshaled recursively.
+//
+// A field whose variable is not set is an error unless its tag has the
+// optional flag, in which case the field is left untouched. Every missing
+// or malformed field is reported in a single *UnmarshalError.
+func Unmarshal(v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() || rv.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("konfig: Unmarshal requires a non-nil pointer to a struct, got %T", v)
+	}
+
+	var errs []*FieldError
+	unmarshalStruct(rv.Elem(), "", &errs)
+
+	if len(errs) > 0 {
+		return &UnmarshalError{Errors: errs}
+	}
+	return nil
+}
+
+func unmarshalStruct(rv reflect.Value, path string, errs *[]*FieldError) {
+	rt := rv.Type()
+	for i := 0; i < rt.NumField(); i++ {
+		field := rt.Field(i)
+		if field.PkgPath != "" && !field.Anonymous {
+			continue
+		}
+
+		fv := rv.Field(i)
+		fieldPath := path + field.Name
+
+		tag, ok := field.Tag.Lookup("konfig")
+		if !ok || tag == "-" {
+			if fv.Kind() == reflect.Struct && field.Type != urlType {
+				unmarshalStruct(fv, fieldPath+".", errs)
+			}
+			continue
+		}
+
+		options := strings.Split(tag, ",")
+		name := options[0]
+		optional := false
+		for _, o := range options[1:] {
+			if o == "optional" {
+				optional = true
+			}
+		}
+
+		value, ok := Lookup(name)
+		if !ok {
+			value, ok = os.LookupEnv(name)
+
+			// A reference left in the environment failed to resolve and
+			// must not be bound as the value.
+			if ok && (isReference(value) || isTemplate(value)) {
+				*errs = append(*errs, &FieldError{Field: fieldPath, Name: name,
+					Err: fmt.Errorf("%w: unresolved reference", ErrMissingValue)})
+				continue
+			}
+		}
+		if !ok {
+			if !optional {
+				*errs = append(*errs, &FieldError{Field: fieldPath, Name: name, Err: ErrMissingValue})
+			}
+			continue
+		}
+
+		if err := setField(fv, value); err != nil {
+			*errs = append(*errs, &FieldError{Field: fieldPath, Name: name,
+				Err: fmt.Errorf("%w: %v", ErrInvalidValue, err)})
+		}
+	}
+}
+
+func setField(fv reflect.Value, value string) error {
+	switch fv.Type() {
+	case durationType:
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		fv.SetInt(int64(d))
+		return nil
+	case urlType:
+		u, err := url.Parse(value)
+		if err != nil {
+			return err
+		}
+		fv.Set(reflect.ValueOf(*u))
+		return nil
+	case bytesType:
+		fv.SetBytes([]byte(value))
+		return nil
+	}
+
+	switch fv.Kind() {
+	case reflect.String:
+		fv.SetString(value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		fv.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(value, 0, fv.Type().Bits())
+		if err != nil {
+			return err
+		}
+		fv.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(value, 0, fv.Type().Bits())
+		if err != nil {
+			return err
+		}
+		fv.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		n, err := strconv.ParseFloat(value, fv.Type().Bits())
+		if err != nil {
+			return err
+		}
+		fv.SetFloat(n)
+	case reflect.Ptr:
+		p := reflect.New(fv.Type().Elem())
+		if err := setField(p.Elem(), value); err != nil {
+			return err
+		}
+		fv.Set(p)
+	case reflect.Slice:
+		var items []string
+		if value != "" {
+			items = strings.Split(value, ",")
+		}
+		s := reflect.MakeSlice(fv.Type(), len(items), len(items))
+		for i, item := range items {
+			if err := setField(s.Index(i), strings.TrimSpace(item)); err != nil {
+				return fmt.Errorf("item %d: %v", i, err)
+			}
+		}
+		fv.Set(s)
+	default:
+		return fmt.Errorf("unsupported type %s", fv.Type())
+	}
+	return nil
+}
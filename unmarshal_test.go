@@ -0,0 +1,113 @@
+package konfig
+
+import (
+	"errors"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestUnmarshal(t *testing.T) {
+	store.set("KONFIG_TEST_PASSWORD", "secret")
+	defer store.delete("KONFIG_TEST_PASSWORD")
+
+	env := map[string]string{
+		"KONFIG_TEST_PORT":     "8080",
+		"KONFIG_TEST_DEBUG":    "true",
+		"KONFIG_TEST_TIMEOUT":  "5s",
+		"KONFIG_TEST_URL":      "postgres://10.0.0.5/db",
+		"KONFIG_TEST_HOSTS":    "a, b,c",
+		"KONFIG_TEST_PORTS":    "80,443",
+		"KONFIG_TEST_PASSWORD": "$SecretKeyRef:/projects/p/zones/z/clusters/c/namespaces/default/secrets/db/keys/password",
+	}
+	for k, v := range env {
+		os.Setenv(k, v)
+		defer os.Unsetenv(k)
+	}
+
+	var config struct {
+		Port     int           `konfig:"KONFIG_TEST_PORT"`
+		Debug    bool          `konfig:"KONFIG_TEST_DEBUG"`
+		Timeout  time.Duration `konfig:"KONFIG_TEST_TIMEOUT"`
+		Hosts    []string      `konfig:"KONFIG_TEST_HOSTS"`
+		Ports    []uint16      `konfig:"KONFIG_TEST_PORTS"`
+		Password []byte        `konfig:"KONFIG_TEST_PASSWORD"`
+		Database struct {
+			URL *url.URL `konfig:"KONFIG_TEST_URL"`
+		}
+		Optional string `konfig:"KONFIG_TEST_OPTIONAL,optional"`
+	}
+
+	if err := Unmarshal(&config); err != nil {
+		t.Fatal(err)
+	}
+
+	if config.Port != 8080 || !config.Debug || config.Timeout != 5*time.Second {
+		t.Errorf("unexpected config %+v", config)
+	}
+	if len(config.Hosts) != 3 || config.Hosts[1] != "b" {
+		t.Errorf("unexpected hosts %v", config.Hosts)
+	}
+	if len(config.Ports) != 2 || config.Ports[1] != 443 {
+		t.Errorf("unexpected ports %v", config.Ports)
+	}
+	if config.Database.URL == nil || config.Database.URL.Host != "10.0.0.5" {
+		t.Errorf("unexpected database url %v", config.Database.URL)
+	}
+	if string(config.Password) != "secret" {
+		t.Errorf("want resolved password, got %s", config.Password)
+	}
+}
+
+func TestUnmarshalErrors(t *testing.T) {
+	os.Setenv("KONFIG_TEST_BAD_PORT", "http")
+	defer os.Unsetenv("KONFIG_TEST_BAD_PORT")
+
+	var config struct {
+		Port    int    `konfig:"KONFIG_TEST_BAD_PORT"`
+		Missing string `konfig:"KONFIG_TEST_MISSING_VALUE"`
+	}
+
+	err := Unmarshal(&config)
+	e, ok := err.(*UnmarshalError)
+	if !ok || len(e.Errors) != 2 {
+		t.Fatalf("want 2 field errors, got %v", err)
+	}
+	if !errors.Is(e.Errors[0], ErrInvalidValue) {
+		t.Errorf("want ErrInvalidValue, got %v", e.Errors[0])
+	}
+	if !errors.Is(e.Errors[1], ErrMissingValue) {
+		t.Errorf("want ErrMissingValue, got %v", e.Errors[1])
+	}
+}
+
+func TestUnmarshalUnresolvedReference(t *testing.T) {
+	env := map[string]string{
+		"KONFIG_TEST_UNRESOLVED": "$SecretKeyRef:/projects/p/zones/z/clusters/c/namespaces/default/secrets/db/keys/password",
+		"KONFIG_TEST_TEMPLATE":   "postgres://app:${SecretKeyRef:/projects/p/zones/z/clusters/c/namespaces/default/secrets/db/keys/password}@db",
+	}
+	for k, v := range env {
+		os.Setenv(k, v)
+		defer os.Unsetenv(k)
+	}
+
+	var config struct {
+		Password string `konfig:"KONFIG_TEST_UNRESOLVED"`
+		URL      string `konfig:"KONFIG_TEST_TEMPLATE,optional"`
+	}
+
+	err := Unmarshal(&config)
+	e, ok := err.(*UnmarshalError)
+	if !ok || len(e.Errors) != 2 {
+		t.Fatalf("want 2 field errors, got %v", err)
+	}
+	for _, err := range e.Errors {
+		if !errors.Is(err, ErrMissingValue) {
+			t.Errorf("want ErrMissingValue, got %v", err)
+		}
+	}
+	if config.Password != "" || config.URL != "" {
+		t.Errorf("want unresolved references left unbound, got %+v", config)
+	}
+}